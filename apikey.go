@@ -0,0 +1,276 @@
+package nelly
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	errInvalidAPIKey = newTokenError("Invalid API key")
+	errExpiredAPIKey = newTokenError("API key is expired")
+)
+
+// APIKey is an entry of an APIKeyStore. The key itself is not stored, only
+// its SHA-256 hash, see HashAPIKey.
+type APIKey struct {
+	// Name of the key, it's the Subject of the identity of the requests
+	Name string `json:"name"`
+	// Hash is the hex encoded SHA-256 hash of the key
+	Hash string `json:"hash"`
+	// Scopes granted to the key
+	Scopes []string `json:"scopes,omitempty"`
+	// Roles granted to the key
+	Roles []string `json:"roles,omitempty"`
+	// ExpiresAt is the time after which the key is rejected, zero if never
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of key, to be stored in APIKey.Hash
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyStore looks up the entries of API keys
+type APIKeyStore interface {
+	// LookupAPIKey returns the entry whose hash is the hash of key, and
+	// false if there is no such entry
+	LookupAPIKey(key string) (*APIKey, bool, error)
+}
+
+// apiKeyEntry is an APIKey with its decoded hash
+type apiKeyEntry struct {
+	APIKey
+	hash []byte
+}
+
+func newAPIKeyEntries(keys []APIKey) ([]apiKeyEntry, error) {
+	entries := make([]apiKeyEntry, len(keys))
+	for i, key := range keys {
+		hash, err := hex.DecodeString(key.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key %q has no valid SHA-256 hash", key.Name)
+		}
+		entries[i] = apiKeyEntry{APIKey: key, hash: hash}
+	}
+	return entries, nil
+}
+
+// lookupAPIKey compares the hash of key with all the entries in constant time
+func lookupAPIKey(entries []apiKeyEntry, key string) (*APIKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	var found *APIKey
+	for i := range entries {
+		if subtle.ConstantTimeCompare(entries[i].hash, sum[:]) == 1 && found == nil {
+			apiKey := entries[i].APIKey
+			found = &apiKey
+		}
+	}
+	return found, found != nil
+}
+
+// MemoryAPIKeyStore is an in-memory APIKeyStore
+type MemoryAPIKeyStore struct {
+	lock    sync.RWMutex
+	entries []apiKeyEntry
+}
+
+// NewMemoryAPIKeyStore creates a new MemoryAPIKeyStore of the given keys.
+// It fails if a key has no valid hash.
+func NewMemoryAPIKeyStore(keys ...APIKey) (*MemoryAPIKeyStore, error) {
+	entries, err := newAPIKeyEntries(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryAPIKeyStore{entries: entries}, nil
+}
+
+// Add adds a key to the store. It fails if the key has no valid hash.
+func (s *MemoryAPIKeyStore) Add(key APIKey) error {
+	entries, err := newAPIKeyEntries([]APIKey{key})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// Remove removes the keys with the given name from the store
+func (s *MemoryAPIKeyStore) Remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make([]apiKeyEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		if entry.Name != name {
+			entries = append(entries, entry)
+		}
+	}
+	s.entries = entries
+}
+
+// LookupAPIKey implements APIKeyStore
+func (s *MemoryAPIKeyStore) LookupAPIKey(key string) (*APIKey, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	apiKey, ok := lookupAPIKey(s.entries, key)
+	return apiKey, ok, nil
+}
+
+// apiKeyFile is the JSON document read by FileAPIKeyStore, e.g.
+//
+//	{
+//	  "keys": [
+//	    {"name": "billing", "hash": "9f86d0...", "scopes": ["invoices:read"]}
+//	  ]
+//	}
+type apiKeyFile struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// FileAPIKeyStore is an APIKeyStore that reads the keys from a JSON file,
+// which is reloaded when it's modified.
+type FileAPIKeyStore struct {
+	file *fileReloader
+
+	lock    sync.RWMutex
+	entries []apiKeyEntry
+}
+
+// NewFileAPIKeyStore creates a new FileAPIKeyStore of the file at path, whose
+// modification time is checked at most once per checkPeriod (10 seconds if
+// zero). It fails if the file can't be read.
+func NewFileAPIKeyStore(path string, checkPeriod time.Duration) (*FileAPIKeyStore, error) {
+	s := &FileAPIKeyStore{}
+
+	file, err := newFileReloader(path, checkPeriod, s.parse)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// Reload reads the file if it was modified since it was last read. On
+// failure, the previously read keys are kept.
+func (s *FileAPIKeyStore) Reload() error {
+	return s.file.reload()
+}
+
+// parse replaces the keys of the store by the keys of the file
+func (s *FileAPIKeyStore) parse(data []byte) error {
+	file := apiKeyFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	entries, err := newAPIKeyEntries(file.Keys)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = entries
+
+	return nil
+}
+
+// LookupAPIKey implements APIKeyStore
+func (s *FileAPIKeyStore) LookupAPIKey(key string) (*APIKey, bool, error) {
+	if err := s.file.reloadIfDue(); err != nil {
+		klog.Errorf("Failed to reload API keys from %s: %v", s.file.path, err)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	apiKey, ok := lookupAPIKey(s.entries, key)
+	return apiKey, ok, nil
+}
+
+// APIKeyOpts is the configuration that will be used by WithAPIKeyAuth and NewAPIKeyAuthenticator
+type APIKeyOpts struct {
+	// Store looks up the entries of the keys
+	Store APIKeyStore
+	// Extractors extract the key from the request, they are tried in order
+	// until a key is found, e.g. FromQuery("api_key").
+	// Default: FromHeader("X-API-Key", "")
+	Extractors []TokenExtractor
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated.
+	// Default: renders errors with an 'APIKey' challenge, see NewBearerErrorRenderer
+	ErrorRenderer ErrorRenderer
+}
+
+// apiKeyAuthenticator authenticates requests with an API key
+type apiKeyAuthenticator struct {
+	opts APIKeyOpts
+}
+
+// NewAPIKeyAuthenticator returns an Authenticator that authenticates requests
+// with the API keys of opts.Store. The identity of the request is the name,
+// scopes and roles of the key.
+func NewAPIKeyAuthenticator(opts APIKeyOpts) Authenticator {
+
+	if opts.Store == nil {
+		klog.Fatalf("API key authentication requires an APIKeyStore")
+	}
+	if len(opts.Extractors) == 0 {
+		opts.Extractors = []TokenExtractor{FromHeader("X-API-Key", "")}
+	}
+
+	return &apiKeyAuthenticator{opts: opts}
+}
+
+// AuthenticateRequest implements Authenticator
+func (a *apiKeyAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	key, err := extractToken(a.opts.Extractors, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if key == "" {
+		return nil, false, nil
+	}
+
+	apiKey, ok, err := a.opts.Store.LookupAPIKey(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to lookup API key: %v", err)
+	}
+	if !ok {
+		return nil, false, errInvalidAPIKey
+	}
+	if !apiKey.ExpiresAt.IsZero() && time.Now().After(apiKey.ExpiresAt) {
+		return nil, false, errExpiredAPIKey
+	}
+
+	return &UserInfo{
+		Subject: apiKey.Name,
+		Scopes:  apiKey.Scopes,
+		Roles:   apiKey.Roles,
+		Expiry:  apiKey.ExpiresAt,
+		Extra:   map[string]interface{}{},
+	}, true, nil
+}
+
+// WithAPIKeyAuth handler authenticates requests with API keys, see NewAPIKeyAuthenticator
+func WithAPIKeyAuth(opts APIKeyOpts) Handler {
+	renderer := opts.ErrorRenderer
+	if renderer == nil {
+		renderer = newChallengeErrorRenderer("APIKey", "")
+	}
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: renderer}, NewAPIKeyAuthenticator(opts))
+}
@@ -0,0 +1,163 @@
+package nelly
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestWithAPIKeyAuth(t *testing.T) {
+	store, err := NewMemoryAPIKeyStore(
+		APIKey{Name: "billing", Hash: HashAPIKey("billing-key"), Scopes: []string{"invoices:read"}},
+		APIKey{Name: "expired", Hash: HashAPIKey("expired-key"), ExpiresAt: time.Now().Add(-time.Minute)},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	withAuth := WithAPIKeyAuth(APIKeyOpts{
+		Store:      store,
+		Extractors: []TokenExtractor{FromHeader("X-API-Key", ""), FromQuery("api_key")},
+	})
+
+	var subject, query string
+	router := httprouter.New()
+	router.GET("/v1", withAuth(WithRequiredScopes("invoices:read")(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user, _ := UserFrom(r.Context())
+		subject = user.Subject
+		query = r.URL.RawQuery
+	})))
+
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		status  int
+		message string
+		subject string
+	}{
+		{"header", "billing-key", "", http.StatusOK, "", "billing"},
+		{"query", "", "api_key=billing-key&page=2", http.StatusOK, "", "billing"},
+		{"no-key", "", "", http.StatusUnauthorized, "Required authorization token not found", ""},
+		{"unknown-key", "other-key", "", http.StatusUnauthorized, "Invalid API key", ""},
+		{"expired-key", "expired-key", "", http.StatusUnauthorized, "API key is expired", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subject, query = "", ""
+
+			req := httptest.NewRequest(http.MethodGet, "/v1?"+test.query, nil)
+			if test.header != "" {
+				req.Header.Set("X-API-Key", test.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if subject != test.subject {
+				t.Errorf("expected subject %q, got %q", test.subject, subject)
+			}
+			if test.status == http.StatusOK {
+				if strings.Contains(query, "api_key") {
+					t.Errorf("expected API key to be removed from query %q", query)
+				}
+				return
+			}
+
+			if challenge := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, "APIKey") {
+				t.Errorf("expected APIKey challenge, got %q", challenge)
+			}
+			var status restutil.Status
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Message != test.message {
+				t.Errorf("expected message %q, got %q", test.message, status.Message)
+			}
+		})
+	}
+}
+
+func TestMemoryAPIKeyStore(t *testing.T) {
+	if _, err := NewMemoryAPIKeyStore(APIKey{Name: "invalid", Hash: "billing-key"}); err == nil {
+		t.Errorf("expected error for invalid hash")
+	}
+
+	store, _ := NewMemoryAPIKeyStore()
+	if err := store.Add(APIKey{Name: "billing", Hash: HashAPIKey("billing-key")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key, ok, _ := store.LookupAPIKey("billing-key"); !ok || key.Name != "billing" {
+		t.Errorf("expected billing key, got %v", key)
+	}
+
+	store.Remove("billing")
+	if _, ok, _ := store.LookupAPIKey("billing-key"); ok {
+		t.Errorf("expected removed key not to be found")
+	}
+}
+
+func TestFileAPIKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	write := func(modTime time.Time, keys ...APIKey) {
+		data, err := json.Marshal(apiKeyFile{Keys: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write(now.Add(-time.Hour), APIKey{Name: "key-1", Hash: HashAPIKey("secret-1")})
+
+	store, err := NewFileAPIKeyStore(path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := store.LookupAPIKey("secret-1"); !ok {
+		t.Errorf("expected key-1 to be found")
+	}
+
+	write(now, APIKey{Name: "key-2", Hash: HashAPIKey("secret-2"), Scopes: []string{"read"}})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, _ := store.LookupAPIKey("secret-1"); ok {
+		t.Errorf("expected key-1 to be removed")
+	}
+	if key, ok, _ := store.LookupAPIKey("secret-2"); !ok || len(key.Scopes) != 1 {
+		t.Errorf("expected key-2 to be found, got %v", key)
+	}
+
+	// the keys are kept if the file is invalid
+	write(now.Add(time.Hour), APIKey{Name: "key-3", Hash: "invalid"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, _ := store.LookupAPIKey("secret-2"); !ok {
+		t.Errorf("expected previous keys to be kept")
+	}
+
+	if _, err := NewFileAPIKeyStore(filepath.Join(dir, "missing.json"), 0); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+}
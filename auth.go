@@ -1,146 +1,319 @@
 package nelly
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
-	"github.com/julienschmidt/httprouter"
+	"k8s.io/klog"
 
-	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
-
-	"github.com/pharmatics/rest-util"
 )
 
-var errorHandler = func(w http.ResponseWriter, r *http.Request, err string) {
-	statusErr := restutil.Error(err, restutil.StatusReasonUnauthorized)
-	restutil.ResponseJSON(statusErr, w, statusErr.Code)
+// KeySource provides the keys used to verify the signature of JWT tokens
+type KeySource interface {
+	// VerificationKey returns the key used to verify the signature of token.
+	// It must fail if the key can't be used with the token signing method.
+	VerificationKey(token *jwt.Token) (interface{}, error)
 }
 
-// Jwks is a set of keys which contains the public keys used to verify JWT issued
-// by the authorization server and signed using the RS256 signing algorithm.
-type Jwks struct {
-	Keys []JSONWebKeys `json:"keys"`
+// HMACSecret is a KeySource of a shared secret for tokens signed with HMAC
+// signing methods (HS256, HS384 and HS512)
+type HMACSecret []byte
+
+// VerificationKey implements KeySource
+func (s HMACSecret) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+	}
+
+	return []byte(s), nil
 }
 
-// JSONWebKeys is a JSON Web Key
-type JSONWebKeys struct {
-	Kty string   `json:"kty"`
-	Kid string   `json:"kid"`
-	Use string   `json:"use"`
-	N   string   `json:"n"`
-	E   string   `json:"e"`
-	X5c []string `json:"x5c"`
+// AuthOpts is the configuration that will be used by WithAuth and NewJWTAuthenticator
+type AuthOpts struct {
+	// Keys provides the keys used to verify the token signature,
+	// e.g. HMACSecret or JWKSCache
+	Keys KeySource
+	// Audience is the expected 'aud' claim, which may be an array of audiences.
+	// It's not checked if empty.
+	Audience string
+	// Issuer is the expected 'iss' claim, it's not checked if empty
+	Issuer string
+	// Algorithms is the set of allowed signing algorithms ('alg' header),
+	// e.g. RS256, ES256, ES384 or EdDSA. If empty, any algorithm that can
+	// be used with the key provided by Keys is allowed.
+	Algorithms []string
+	// ClaimsMapper maps the claims of the validated token to the UserInfo
+	// stored in the request context.
+	// Default: DefaultClaimsMapper
+	ClaimsMapper ClaimsMapper
+	// Extractors extract the token from the request, they are tried in order
+	// until a token is found.
+	// Default: FromHeader("Authorization", "Bearer")
+	Extractors []TokenExtractor
+	// TokenCache caches the identity of validated tokens to skip the signature
+	// verification of tokens that are sent again. The cached tokens are validated
+	// again when the keys of a RotatingKeySource are rotated.
+	// Default: disabled
+	TokenCache TokenCacheOpts
+	// Revocations is checked for revoked tokens after the token is validated,
+	// including the tokens found in TokenCache.
+	// Default: nil (tokens are not checked for revocation)
+	Revocations RevocationStore
+	// Validation configures the validation of the token claims, e.g. the
+	// required claims and the allowed clock skew
+	Validation ValidationOpts
+	// DPoP configures the validation of the DPoP proofs of the tokens bound
+	// to a key (RFC 9449).
+	// Default: disabled
+	DPoP DPoPOpts
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated, e.g. NewBearerErrorRenderer with the realm of the API.
+	// Default: DefaultErrorRenderer, or NewDPoPErrorRenderer if DPoP is enabled
+	ErrorRenderer ErrorRenderer
 }
 
-func getPemCert(token *jwt.Token, jwksURL string) (string, error) {
-	cert := ""
-	resp, err := http.Get(jwksURL)
+// jwtAuthenticator authenticates requests with a JWT bearer token
+type jwtAuthenticator struct {
+	opts   AuthOpts
+	cache  *tokenCache
+	parser *jwt.Parser
+}
 
-	if err != nil {
-		return cert, err
+// NewJWTAuthenticator returns an Authenticator that validates JWT tokens signed
+// with any of the allowed algorithms and verified with the keys of opts.Keys.
+// Requests without a token are not authenticated by it.
+func NewJWTAuthenticator(opts AuthOpts) Authenticator {
+
+	if opts.Keys == nil {
+		klog.Fatalf("JWT authentication requires a KeySource to verify tokens")
+	}
+	if opts.ClaimsMapper == nil {
+		opts.ClaimsMapper = DefaultClaimsMapper
+	}
+	if len(opts.Extractors) == 0 {
+		opts.Extractors = defaultExtractors
+	}
+	if opts.DPoP.Enabled {
+		opts.DPoP = dpopOptsWithDefaults(opts.DPoP)
 	}
-	defer resp.Body.Close()
 
-	var jwks = Jwks{}
-	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	return &jwtAuthenticator{
+		opts:  opts,
+		cache: newTokenCache(opts.TokenCache),
+		// The claims are validated by opts.Validation
+		parser: &jwt.Parser{SkipClaimsValidation: true},
+	}
+}
 
+// AuthenticateRequest implements Authenticator
+func (a *jwtAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	token, dpop, err := a.extractToken(req)
 	if err != nil {
-		return cert, err
+		return nil, false, err
+	}
+	if token == "" {
+		return nil, false, nil
+	}
+
+	user, id, err := a.authenticateToken(token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := a.verifyDPoP(req, token, dpop, id); err != nil {
+		return nil, false, err
 	}
 
-	for k := range jwks.Keys {
-		if token.Header["kid"] == jwks.Keys[k].Kid {
-			cert = "-----BEGIN CERTIFICATE-----\n" + jwks.Keys[k].X5c[0] + "\n-----END CERTIFICATE-----"
+	return user, true, nil
+}
+
+// verifyDPoP checks the DPoP proof of the token if DPoP is enabled, the
+// tokens sent with the DPoP scheme are rejected otherwise
+func (a *jwtAuthenticator) verifyDPoP(req *http.Request, token string, dpop bool, id tokenID) error {
+	if !a.opts.DPoP.Enabled {
+		if dpop {
+			return errDPoPNotAccepted
 		}
+		return nil
 	}
+	return a.opts.DPoP.verifyRequest(req, token, dpop, id, time.Now())
+}
 
-	if cert == "" {
-		err := errors.New("Invlid token: can't find appropriate kid header claim")
-		return cert, err
+// extractToken returns the token of the request, and whether it's sent with
+// the DPoP scheme
+func (a *jwtAuthenticator) extractToken(req *http.Request) (string, bool, error) {
+	if a.opts.DPoP.Enabled {
+		token, err := dpopExtractor(req)
+		if err != nil || token != "" {
+			return token, token != "", err
+		}
 	}
 
-	return cert, nil
+	token, err := extractToken(a.opts.Extractors, req)
+	return token, false, err
 }
 
-// WithAuthSigningMethodHS256 handler authinticates requests with JWT token using HS256 algorithm
-func WithAuthSigningMethodHS256(secret string, audience string, issuer string) Handler {
+// authenticateToken validates the token and maps its claims to the user
+func (a *jwtAuthenticator) authenticateToken(token string) (*UserInfo, tokenID, error) {
+	user, id, err := a.verifyToken(token)
+	if err != nil {
+		return nil, id, err
+	}
 
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-
-			// Verify 'aud' claim
-			checkAud := token.Claims.(jwt.MapClaims).VerifyAudience(audience, false)
-			if !checkAud {
-				return token, errors.New("Invalid audience")
-			}
-			// Verify 'iss' claim
-			checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(issuer, false)
-			if !checkIss {
-				return token, errors.New("Invalid issuer")
-			}
-
-			return []byte(secret), nil
-		},
-		// When set, the middleware verifies that tokens are signed with the specific signing algorithm
-		// If the signing method is not constant the ValidationKeyGetter callback can be used to implement additional checks
-		// Important to avoid security issues described here: https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
-		SigningMethod: jwt.SigningMethodHS256,
-		ErrorHandler:  errorHandler,
-	})
+	if a.opts.Revocations != nil {
+		if err := checkRevocation(a.opts.Revocations, user, id); err != nil {
+			return nil, id, err
+		}
+	}
 
-	return withAuth(jwtMiddleware)
+	return user, id, nil
 }
 
-// WithAuthSigningMethodRS256 handler authinticates requests  with JWT token using RS256 algorithm
-func WithAuthSigningMethodRS256(jwksEndpoint string, audience string, issuer string) Handler {
+// verifyToken returns the user of the token from the token cache, or validates the token
+func (a *jwtAuthenticator) verifyToken(token string) (*UserInfo, tokenID, error) {
+	if a.cache == nil {
+		return a.validateToken(token)
+	}
 
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-
-			// Verify 'aud' claim
-			checkAud := token.Claims.(jwt.MapClaims).VerifyAudience(audience, false)
-			if !checkAud {
-				return token, errors.New("Invalid audience")
-			}
-			// Verify 'iss' claim
-			checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(issuer, false)
-			if !checkIss {
-				return token, errors.New("Invalid issuer")
-			}
-
-			cert, err := getPemCert(token, jwksEndpoint)
-			if err != nil {
-				return nil, err
-			}
-
-			result, _ := jwt.ParseRSAPublicKeyFromPEM([]byte(cert))
-			return result, nil
-		},
-		SigningMethod: jwt.SigningMethodRS256,
-		ErrorHandler:  errorHandler,
-	})
+	// The version is read before the validation, so a token validated while
+	// the keys are rotated is validated again
+	keysVersion := a.keysVersion()
+	if user, id, ok := a.cache.get(token, keysVersion); ok {
+		return user, id, nil
+	}
+
+	user, id, err := a.validateToken(token)
+	if err != nil {
+		return nil, id, err
+	}
+	a.cache.add(token, user, id, keysVersion)
+
+	return user, id, nil
+}
+
+// validateToken verifies the token signature and claims, and maps its claims to the user
+func (a *jwtAuthenticator) validateToken(token string) (*UserInfo, tokenID, error) {
+	parsedToken, err := a.parser.Parse(token, a.validationKey)
+	if err != nil {
+		// Return the errors of validationKey as is, e.g. ErrInvalidAudience
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner != nil {
+			return nil, tokenID{}, validationErr.Inner
+		}
+		return nil, tokenID{}, err
+	}
+
+	// Check if the parsed token is valid...
+	if !parsedToken.Valid {
+		return nil, tokenID{}, errInvalidToken
+	}
+
+	claims := parsedToken.Claims.(jwt.MapClaims)
+	if err := a.opts.Validation.validateClaims(claims, time.Now()); err != nil {
+		return nil, tokenID{}, err
+	}
 
-	return withAuth(jwtMiddleware)
+	user, err := a.opts.ClaimsMapper(claims)
+	if err != nil {
+		return nil, tokenID{}, err
+	}
+
+	id := claimsTokenID(claims)
+	id.notAfter = a.opts.Validation.notAfter(claims)
+
+	return user, id, nil
 }
 
-func withAuth(jwtMiddleware *jwtmiddleware.JWTMiddleware) Handler {
+func (a *jwtAuthenticator) keysVersion() uint64 {
+	if keys, ok := a.opts.Keys.(RotatingKeySource); ok {
+		return keys.KeysVersion()
+	}
+	return 0
+}
+
+// validationKey is the jwt.Keyfunc of the authenticator. The signing method is checked
+// against opts.Algorithms and against the key type by opts.Keys.
+// Important to avoid security issues described here: https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
+func (a *jwtAuthenticator) validationKey(token *jwt.Token) (interface{}, error) {
 
-	fn := func(h httprouter.Handle) httprouter.Handle {
+	// Verify 'alg' header
+	if !algorithmAllowed(a.opts.Algorithms, token.Method.Alg()) {
+		return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+	}
+	// Verify 'aud' claim
+	checkAud := verifyAudience(token.Claims.(jwt.MapClaims), a.opts.Audience, a.opts.Validation.RequireAudience)
+	if !checkAud {
+		return token, ErrInvalidAudience
+	}
+	// Verify 'iss' claim
+	checkIss := verifyIssuer(token.Claims.(jwt.MapClaims), a.opts.Issuer, a.opts.Validation.RequireIssuer)
+	if !checkIss {
+		return token, ErrInvalidIssuer
+	}
 
-		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
-			err := jwtMiddleware.CheckJWT(w, req)
+	return a.opts.Keys.VerificationKey(token)
+}
 
-			// If there was an error, do not continue.
-			if err != nil {
-				return
-			}
-			// Dispatch to the internal handler
-			h(w, req, p)
+func algorithmAllowed(algorithms []string, alg string) bool {
+	if len(algorithms) == 0 {
+		return true
+	}
+	for _, a := range algorithms {
+		if a == alg {
+			return true
 		}
 	}
+	return false
+}
+
+// WithAuth handler authenticates requests with JWT token signed with any of
+// the allowed algorithms and verified with the keys of opts.Keys
+func WithAuth(opts AuthOpts) Handler {
+	renderer := opts.ErrorRenderer
+	if renderer == nil && opts.DPoP.Enabled {
+		renderer = NewDPoPErrorRenderer("", opts.DPoP)
+	}
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: renderer}, NewJWTAuthenticator(opts))
+}
+
+// NewHS256Authenticator returns an Authenticator that validates JWT token using HS256 algorithm
+func NewHS256Authenticator(secret string, audience string, issuer string) Authenticator {
+	return NewJWTAuthenticator(AuthOpts{
+		Keys:       HMACSecret(secret),
+		Audience:   audience,
+		Issuer:     issuer,
+		Algorithms: []string{jwt.SigningMethodHS256.Alg()},
+	})
+}
 
-	return fn
+// NewRS256Authenticator returns an Authenticator that validates JWT token using RS256 algorithm
+// and the keys of the given JWKSCache
+func NewRS256Authenticator(jwks *JWKSCache, audience string, issuer string) Authenticator {
+	return NewJWTAuthenticator(AuthOpts{
+		Keys:       jwks,
+		Audience:   audience,
+		Issuer:     issuer,
+		Algorithms: []string{jwt.SigningMethodRS256.Alg()},
+	})
+}
+
+// WithAuthSigningMethodHS256 handler authenticates requests with JWT token using HS256 algorithm
+func WithAuthSigningMethodHS256(secret string, audience string, issuer string) Handler {
+	return WithAuthentication(NewHS256Authenticator(secret, audience, issuer))
+}
+
+// WithAuthSigningMethodRS256 handler authenticates requests  with JWT token using RS256 algorithm.
+// The keys of jwksEndpoint are cached, and fetched again by the requests once
+// they expired or when the token has an unknown kid. Use
+// WithAuthSigningMethodRS256JWKS with a JWKSCache refreshed by Run to refresh
+// them in the background.
+func WithAuthSigningMethodRS256(jwksEndpoint string, audience string, issuer string) Handler {
+	return WithAuthSigningMethodRS256JWKS(NewJWKSCache(JWKSOpts{URL: jwksEndpoint}), audience, issuer)
+}
 
+// WithAuthSigningMethodRS256JWKS handler authenticates requests with JWT token using RS256 algorithm
+// and the keys of the given JWKSCache
+func WithAuthSigningMethodRS256JWKS(jwks *JWKSCache, audience string, issuer string) Handler {
+	return WithAuthentication(NewRS256Authenticator(jwks, audience, issuer))
 }
@@ -0,0 +1,120 @@
+package nelly
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Authenticator authenticates the credentials of a request
+type Authenticator interface {
+	// AuthenticateRequest returns the user of the request and true if the request
+	// is authenticated. It returns false and no error if the request has no
+	// credentials for this authenticator ("not mine"), and an error if the
+	// credentials are invalid.
+	AuthenticateRequest(req *http.Request) (*UserInfo, bool, error)
+}
+
+// AuthenticatorFunc is an adapter to use a function as an Authenticator
+type AuthenticatorFunc func(req *http.Request) (*UserInfo, bool, error)
+
+// AuthenticateRequest calls f(req)
+func (f AuthenticatorFunc) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	return f(req)
+}
+
+// unionAuthenticator authenticates the request with a list of authenticators
+type unionAuthenticator []Authenticator
+
+// NewUnionAuthenticator returns an Authenticator that tries the authenticators
+// in order and returns the first success. If no authenticator succeeds, the
+// errors of all the authenticators are returned.
+func NewUnionAuthenticator(authenticators ...Authenticator) Authenticator {
+	return unionAuthenticator(authenticators)
+}
+
+// AuthenticateRequest implements Authenticator
+func (authHandler unionAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	var errs aggregateError
+
+	for _, currAuthRequestHandler := range authHandler {
+		user, ok, err := currAuthRequestHandler.AuthenticateRequest(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if ok {
+			return user, ok, err
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return nil, false, errs[0]
+	}
+
+	return nil, false, errs
+}
+
+// AuthenticationOpts is the configuration that will be used by WithAuthenticationOpts
+type AuthenticationOpts struct {
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated. It's also used by the authorization handlers chained
+	// after the authentication handler, e.g. WithRequiredScopes.
+	// Default: DefaultErrorRenderer
+	ErrorRenderer ErrorRenderer
+}
+
+// WithAuthentication handler authenticates requests with the authenticators
+// which are tried in order, and stores the user of the first success in the
+// request context. If no authenticator succeeds, the handler will return
+// StatusUnauthorized. OPTIONS requests (CORS preflight) are not authenticated.
+func WithAuthentication(authenticators ...Authenticator) Handler {
+	return WithAuthenticationOpts(AuthenticationOpts{}, authenticators...)
+}
+
+// WithAuthenticationOpts handler authenticates requests like WithAuthentication,
+// and renders its errors with opts.ErrorRenderer
+func WithAuthenticationOpts(opts AuthenticationOpts, authenticators ...Authenticator) Handler {
+
+	authenticator := NewUnionAuthenticator(authenticators...)
+	renderer := opts.ErrorRenderer
+	if renderer == nil {
+		renderer = DefaultErrorRenderer
+	}
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			if req.Method == http.MethodOptions {
+				h(w, req, p)
+				return
+			}
+
+			user, ok, err := authenticator.AuthenticateRequest(req)
+			if err != nil {
+				authErr := toAuthError(err)
+				authFailures.WithLabelValues(authErr.Code).Inc()
+				renderer(w, req, authErr)
+				return
+			}
+			if !ok {
+				authFailures.WithLabelValues("no_credentials").Inc()
+				renderer(w, req, errNoCredentials)
+				return
+			}
+
+			ctx := withErrorRenderer(req.Context(), renderer)
+			req = req.WithContext(WithUser(ctx, user))
+
+			// Dispatch to the internal handler
+			h(w, req, p)
+		}
+	}
+
+	return fn
+}
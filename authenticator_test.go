@@ -0,0 +1,145 @@
+package nelly
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+func resultAuthenticator(user *UserInfo, ok bool, err error) Authenticator {
+	return AuthenticatorFunc(func(*http.Request) (*UserInfo, bool, error) {
+		return user, ok, err
+	})
+}
+
+func TestUnionAuthenticator(t *testing.T) {
+	user1, user2 := &UserInfo{Subject: "user1"}, &UserInfo{Subject: "user2"}
+
+	tests := []struct {
+		name           string
+		authenticators []Authenticator
+		user           *UserInfo
+		ok             bool
+		err            string
+	}{
+		{"empty", nil, nil, false, ""},
+		{"not-mine", []Authenticator{
+			resultAuthenticator(nil, false, nil),
+			resultAuthenticator(nil, false, nil),
+		}, nil, false, ""},
+		{"first-success", []Authenticator{
+			resultAuthenticator(nil, false, nil),
+			resultAuthenticator(user1, true, nil),
+			resultAuthenticator(user2, true, nil),
+		}, user1, true, ""},
+		{"success-after-error", []Authenticator{
+			resultAuthenticator(nil, false, errors.New("invalid issuer")),
+			resultAuthenticator(user2, true, nil),
+		}, user2, true, ""},
+		{"error", []Authenticator{
+			resultAuthenticator(nil, false, errors.New("invalid issuer")),
+			resultAuthenticator(nil, false, nil),
+		}, nil, false, "invalid issuer"},
+		{"errors", []Authenticator{
+			resultAuthenticator(nil, false, errors.New("invalid issuer")),
+			resultAuthenticator(nil, false, errors.New("invalid key")),
+		}, nil, false, "[invalid issuer, invalid key]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, ok, err := NewUnionAuthenticator(test.authenticators...).AuthenticateRequest(req)
+			if user != test.user || ok != test.ok {
+				t.Errorf("expected %v %v, got %v %v", test.user, test.ok, user, ok)
+			}
+			if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestWithAuthentication(t *testing.T) {
+	apiKeyAuthenticator := AuthenticatorFunc(func(req *http.Request) (*UserInfo, bool, error) {
+		key := req.Header.Get("X-API-Key")
+		switch key {
+		case "":
+			return nil, false, nil
+		case "valid":
+			return &UserInfo{Subject: "machine"}, true, nil
+		}
+		return nil, false, errors.New("Invalid API key")
+	})
+
+	withAuthentication := WithAuthentication(
+		NewHS256Authenticator("secret-1", "", "issuer-1"),
+		NewHS256Authenticator("secret-2", "", "issuer-2"),
+		apiKeyAuthenticator,
+	)
+
+	var subject string
+	handler := withAuthentication(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		subject = ""
+		if user, ok := UserFrom(r.Context()); ok {
+			subject = user.Subject
+		}
+	})
+
+	router := httprouter.New()
+	router.GET("/v1", handler)
+	router.OPTIONS("/v1", handler)
+
+	tests := []struct {
+		name    string
+		method  string
+		token   string
+		apiKey  string
+		status  int
+		subject string
+	}{
+		{"issuer-1", http.MethodGet, signTestToken(t, jwt.SigningMethodHS256, []byte("secret-1"), "", jwt.MapClaims{"iss": "issuer-1", "sub": "user1"}), "", http.StatusOK, "user1"},
+		{"issuer-2", http.MethodGet, signTestToken(t, jwt.SigningMethodHS256, []byte("secret-2"), "", jwt.MapClaims{"iss": "issuer-2", "sub": "user2"}), "", http.StatusOK, "user2"},
+		{"api-key", http.MethodGet, "", "valid", http.StatusOK, "machine"},
+		{"invalid-token-valid-api-key", http.MethodGet, "invalid", "valid", http.StatusOK, "machine"},
+		{"wrong-secret", http.MethodGet, signTestToken(t, jwt.SigningMethodHS256, []byte("secret-1"), "", jwt.MapClaims{"iss": "issuer-2"}), "", http.StatusUnauthorized, ""},
+		{"invalid-api-key", http.MethodGet, "", "invalid", http.StatusUnauthorized, ""},
+		{"no-credentials", http.MethodGet, "", "", http.StatusUnauthorized, ""},
+		{"options", http.MethodOptions, "", "", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subject = ""
+
+			req, err := http.NewRequest(test.method, "/v1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.apiKey != "" {
+				req.Header.Set("X-API-Key", test.apiKey)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if subject != test.subject {
+				t.Errorf("expected subject %q, got %q", test.subject, subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package nelly
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+
+	"github.com/pharmatics/rest-util"
+)
+
+// Error codes of the WWW-Authenticate challenge (RFC 6750)
+const (
+	// ErrorCodeInvalidRequest is the code of malformed requests, e.g. an
+	// Authorization header with a malformed token
+	ErrorCodeInvalidRequest = "invalid_request"
+	// ErrorCodeInvalidToken is the code of expired, revoked or invalid tokens
+	ErrorCodeInvalidToken = "invalid_token"
+	// ErrorCodeInsufficientScope is the code of tokens without the permissions
+	// required by the request
+	ErrorCodeInsufficientScope = "insufficient_scope"
+	// ErrorCodeInvalidDPoPProof is the code of missing or invalid DPoP
+	// proofs (RFC 9449)
+	ErrorCodeInvalidDPoPProof = "invalid_dpop_proof"
+)
+
+// AuthError is an authentication or authorization failure of a request that
+// is rendered by an ErrorRenderer
+type AuthError struct {
+	// Code is the RFC 6750 error code, empty if the request has no credentials
+	Code string
+	// Description is a human-readable description of the error, which is
+	// sent to the client
+	Description string
+	// Scopes are the scopes required by an insufficient_scope error
+	Scopes []string
+	// Missing are the permissions missing for an insufficient_scope error
+	Missing []string
+	// Err is the underlying error, it's logged but never sent to the client
+	Err error
+}
+
+// Error implements error
+func (e *AuthError) Error() string {
+	return e.Description
+}
+
+// StatusCode returns the HTTP status code of the error
+func (e *AuthError) StatusCode() int {
+	switch e.Code {
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeInsufficientScope:
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// newTokenError returns an invalid_token AuthError with the given description
+func newTokenError(description string) *AuthError {
+	return &AuthError{Code: ErrorCodeInvalidToken, Description: description}
+}
+
+var (
+	errNoCredentials = &AuthError{Description: "Required authorization token not found"}
+	// errInvalidToken is returned in place of the errors whose details must
+	// not be sent to the client, e.g. the failures to fetch the keys
+	errInvalidToken = newTokenError("The token isn't valid")
+)
+
+// aggregateError is the error of several authenticators
+type aggregateError []error
+
+func (errs aggregateError) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return "[" + strings.Join(messages, ", ") + "]"
+}
+
+// toAuthError returns the AuthError of err. The errors that are not AuthError
+// are logged and replaced by a generic invalid_token error.
+func toAuthError(err error) *AuthError {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr
+	}
+
+	if errs, ok := err.(aggregateError); ok {
+		aggregate := &AuthError{Code: ErrorCodeInvalidToken, Err: err}
+		descriptions := make([]string, len(errs))
+		for i, err := range errs {
+			authErr := toAuthError(err)
+			if authErr.Code == ErrorCodeInvalidRequest {
+				aggregate.Code = ErrorCodeInvalidRequest
+			}
+			descriptions[i] = authErr.Description
+		}
+		aggregate.Description = "[" + strings.Join(descriptions, ", ") + "]"
+		return aggregate
+	}
+
+	klog.V(2).Infof("Failed to authenticate request: %v", err)
+	return &AuthError{Code: errInvalidToken.Code, Description: errInvalidToken.Description, Err: err}
+}
+
+// ErrorRenderer writes the response of a request that failed to be
+// authenticated or authorized
+type ErrorRenderer func(w http.ResponseWriter, r *http.Request, err *AuthError)
+
+// DefaultErrorRenderer renders errors with a Bearer challenge without realm,
+// see NewBearerErrorRenderer
+var DefaultErrorRenderer = NewBearerErrorRenderer("")
+
+// NewBearerErrorRenderer returns an ErrorRenderer that sets the RFC 6750
+// WWW-Authenticate header, e.g. 'Bearer realm="api", error="invalid_token",
+// error_description="Token is expired"', and writes a JSON status body.
+func NewBearerErrorRenderer(realm string) ErrorRenderer {
+	return newChallengeErrorRenderer("Bearer", realm)
+}
+
+// newChallengeErrorRenderer returns an ErrorRenderer of the WWW-Authenticate
+// challenge of the given scheme
+func newChallengeErrorRenderer(scheme string, realm string) ErrorRenderer {
+	return func(w http.ResponseWriter, r *http.Request, err *AuthError) {
+		w.Header().Add("WWW-Authenticate", challenge(scheme, realm, err))
+		writeAuthError(w, err)
+	}
+}
+
+// writeAuthError writes the JSON status body of err
+func writeAuthError(w http.ResponseWriter, err *AuthError) {
+	reason := restutil.StatusReasonUnauthorized
+	switch err.StatusCode() {
+	case http.StatusBadRequest:
+		reason = restutil.StatusReasonBadRequest
+	case http.StatusForbidden:
+		reason = restutil.StatusReasonForbidden
+	}
+
+	statusErr := restutil.Error(err.Description, reason)
+	if err.Missing != nil {
+		statusErr.Details = err.Missing
+	}
+	restutil.ResponseJSON(statusErr, w, statusErr.Code)
+}
+
+// challenge returns the WWW-Authenticate challenge of err
+func challenge(scheme string, realm string, err *AuthError) string {
+	var params []string
+	if realm != "" {
+		params = append(params, `realm="`+quotable(realm)+`"`)
+	}
+	if err.Code != "" {
+		params = append(params, `error="`+err.Code+`"`)
+		if err.Description != "" {
+			params = append(params, `error_description="`+quotable(err.Description)+`"`)
+		}
+	}
+	if len(err.Scopes) != 0 {
+		params = append(params, `scope="`+quotable(strings.Join(err.Scopes, " "))+`"`)
+	}
+
+	if len(params) == 0 {
+		return scheme
+	}
+	return scheme + " " + strings.Join(params, ", ")
+}
+
+// quotable removes the characters that are not allowed in the quoted
+// parameters of a challenge (RFC 6750 section 3)
+func quotable(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+type errorRendererContextKeyType int
+
+const errorRendererKey errorRendererContextKeyType = iota
+
+// withErrorRenderer returns a copy of ctx in which the renderer of the
+// authentication handler is stored for the authorization handlers
+func withErrorRenderer(ctx context.Context, renderer ErrorRenderer) context.Context {
+	return context.WithValue(ctx, errorRendererKey, renderer)
+}
+
+// errorRendererFrom returns the renderer of the authentication handler of
+// the request, or DefaultErrorRenderer
+func errorRendererFrom(ctx context.Context) ErrorRenderer {
+	if renderer, ok := ctx.Value(errorRendererKey).(ErrorRenderer); ok {
+		return renderer
+	}
+	return DefaultErrorRenderer
+}
@@ -0,0 +1,135 @@
+package nelly
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestBearerErrorRenderer(t *testing.T) {
+	tests := []struct {
+		name      string
+		realm     string
+		err       *AuthError
+		status    int
+		challenge string
+		message   string
+	}{
+		{"no-credentials", "api", errNoCredentials, http.StatusUnauthorized,
+			`Bearer realm="api"`, "Required authorization token not found"},
+		{"no-credentials-no-realm", "", errNoCredentials, http.StatusUnauthorized,
+			`Bearer`, "Required authorization token not found"},
+		{"invalid-token", "api", ErrTokenExpired.(*AuthError), http.StatusUnauthorized,
+			`Bearer realm="api", error="invalid_token", error_description="Token is expired"`, "Token is expired"},
+		{"invalid-request", "", &AuthError{Code: ErrorCodeInvalidRequest, Description: "Malformed \"token\""}, http.StatusBadRequest,
+			`Bearer error="invalid_request", error_description="Malformed token"`, "Malformed \"token\""},
+		{"insufficient-scope", "api", &AuthError{Code: ErrorCodeInsufficientScope, Description: "Missing permissions", Scopes: []string{"read", "write"}}, http.StatusForbidden,
+			`Bearer realm="api", error="insufficient_scope", error_description="Missing permissions", scope="read write"`, "Missing permissions"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewBearerErrorRenderer(test.realm)(w, httptest.NewRequest(http.MethodGet, "/v1", nil), test.err)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+				t.Errorf("expected challenge %q, got %q", test.challenge, challenge)
+			}
+
+			var status restutil.Status
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Message != test.message {
+				t.Errorf("expected message %q, got %q", test.message, status.Message)
+			}
+		})
+	}
+}
+
+func TestToAuthError(t *testing.T) {
+	internal := errors.New("Failed to fetch JWKS: dial tcp 10.0.0.1:443: i/o timeout")
+
+	tests := []struct {
+		name        string
+		err         error
+		code        string
+		description string
+	}{
+		{"auth-error", ErrInvalidIssuer, ErrorCodeInvalidToken, "Invalid issuer"},
+		{"internal", internal, ErrorCodeInvalidToken, "The token isn't valid"},
+		{"aggregate", aggregateError{ErrTokenExpired, internal}, ErrorCodeInvalidToken, "[Token is expired, The token isn't valid]"},
+		{"aggregate-invalid-request", aggregateError{internal, &AuthError{Code: ErrorCodeInvalidRequest, Description: "Malformed"}}, ErrorCodeInvalidRequest, "[The token isn't valid, Malformed]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authErr := toAuthError(test.err)
+			if authErr.Code != test.code || authErr.Description != test.description {
+				t.Errorf("expected %s %q, got %s %q", test.code, test.description, authErr.Code, authErr.Description)
+			}
+		})
+	}
+}
+
+func TestWithAuthenticationOptsErrorRenderer(t *testing.T) {
+	var rendered []string
+	renderer := func(w http.ResponseWriter, r *http.Request, err *AuthError) {
+		rendered = append(rendered, err.Code)
+		w.WriteHeader(err.StatusCode())
+	}
+
+	authenticator := AuthenticatorFunc(func(req *http.Request) (*UserInfo, bool, error) {
+		switch req.Header.Get("Authorization") {
+		case "":
+			return nil, false, nil
+		case "Bearer internal":
+			return nil, false, errors.New("internal error")
+		}
+		return &UserInfo{Subject: "user", Scopes: []string{"read"}}, true, nil
+	})
+
+	withAuth := WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: renderer}, authenticator)
+
+	router := httprouter.New()
+	router.GET("/v1", withAuth(WithRequiredScopes("write")(func(http.ResponseWriter, *http.Request, httprouter.Params) {})))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		code          string
+	}{
+		{"no-credentials", "", http.StatusUnauthorized, ""},
+		{"internal", "Bearer internal", http.StatusUnauthorized, ErrorCodeInvalidToken},
+		{"insufficient-scope", "Bearer valid", http.StatusForbidden, ErrorCodeInsufficientScope},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered = nil
+
+			req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if len(rendered) != 1 || rendered[0] != test.code {
+				t.Errorf("expected error %q to be rendered once, got %v", test.code, rendered)
+			}
+		})
+	}
+}
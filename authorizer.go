@@ -0,0 +1,174 @@
+package nelly
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/pharmatics/rest-util"
+)
+
+// Decision is the result of an Authorizer
+type Decision int
+
+const (
+	// DecisionDeny means that an authorizer decided to deny the action.
+	DecisionDeny Decision = iota
+	// DecisionAllow means that an authorizer decided to allow the action.
+	DecisionAllow
+	// DecisionNoOpinion means that an authorizer has no opinion on whether
+	// to allow or deny an action.
+	DecisionNoOpinion
+)
+
+// Attributes are the attributes of a request that an Authorizer decides on
+type Attributes struct {
+	// User is the authenticated user, nil if the request is not authenticated
+	User *UserInfo
+	// Verb is the kubernetes-style verb of the request method: get, create,
+	// update, patch or delete, or the lowercased method for other methods
+	Verb string
+	// Path is the path of the requested resource
+	Path string
+	// Params are the route params of the requested resource
+	Params httprouter.Params
+	// Resource and Name are the impersonated resource, "users", "groups" or
+	// "userextras/<key>", and its value for the "impersonate" verb
+	Resource string
+	Name     string
+}
+
+// Authorizer makes an authorization decision based on the attributes of a request
+type Authorizer interface {
+	// Authorize returns the decision and the reason of the decision. An error
+	// may be returned with any decision if the authorizer failed partially.
+	Authorize(ctx context.Context, a Attributes) (authorized Decision, reason string, err error)
+}
+
+// AuthorizerFunc is an adapter to use a function as an Authorizer
+type AuthorizerFunc func(ctx context.Context, a Attributes) (Decision, string, error)
+
+// Authorize calls f(ctx, a)
+func (f AuthorizerFunc) Authorize(ctx context.Context, a Attributes) (Decision, string, error) {
+	return f(ctx, a)
+}
+
+// unionAuthorizer authorizes the request with a list of authorizers
+type unionAuthorizer []Authorizer
+
+// NewUnionAuthorizer returns an Authorizer that asks the authorizers in order
+// and returns the first decision that is not DecisionNoOpinion
+func NewUnionAuthorizer(authorizers ...Authorizer) Authorizer {
+	return unionAuthorizer(authorizers)
+}
+
+// Authorize implements Authorizer
+func (authzHandler unionAuthorizer) Authorize(ctx context.Context, a Attributes) (Decision, string, error) {
+	var (
+		errs    []string
+		reasons []string
+	)
+
+	for _, currAuthzHandler := range authzHandler {
+		decision, reason, err := currAuthzHandler.Authorize(ctx, a)
+
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		if len(reason) != 0 {
+			reasons = append(reasons, reason)
+		}
+		switch decision {
+		case DecisionAllow, DecisionDeny:
+			return decision, reason, err
+		case DecisionNoOpinion:
+			// continue to the next authorizer
+		}
+	}
+
+	if len(errs) != 0 {
+		return DecisionNoOpinion, strings.Join(reasons, "\n"), fmt.Errorf("[%s]", strings.Join(errs, ", "))
+	}
+
+	return DecisionNoOpinion, strings.Join(reasons, "\n"), nil
+}
+
+// WithAuthorization handler passes the request to the authorizer, and only
+// dispatches it to the next handler if it is allowed. Otherwise, the handler
+// will return StatusForbidden with the reason of the decision. It must be
+// chained after an authentication handler.
+func WithAuthorization(authorizer Authorizer) Handler {
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			attributes := authorizationAttributes(req, p)
+
+			authorized, reason, err := authorizer.Authorize(req.Context(), attributes)
+			if authorized == DecisionAllow {
+				h(w, req, p)
+				return
+			}
+			if err != nil {
+				klog.Errorf("Failed to authorize %v %v: %v", req.Method, req.URL.Path, err)
+				statusErr := restutil.Error("Failed to authorize request", restutil.StatusReasonInternalError)
+				restutil.ResponseJSON(statusErr, w, statusErr.Code)
+				return
+			}
+
+			klog.V(4).Infof("Forbidden: %v %v, Reason: %q", req.Method, req.URL.Path, reason)
+			statusErr := restutil.Error(forbiddenMessage(attributes, reason), restutil.StatusReasonForbidden)
+			restutil.ResponseJSON(statusErr, w, statusErr.Code)
+		}
+	}
+
+	return fn
+}
+
+func authorizationAttributes(req *http.Request, p httprouter.Params) Attributes {
+	user, _ := UserFrom(req.Context())
+
+	return Attributes{
+		User:   user,
+		Verb:   requestVerb(req.Method),
+		Path:   req.URL.Path,
+		Params: p,
+	}
+}
+
+// requestVerb maps the request method to a kubernetes-style verb
+func requestVerb(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "get"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return strings.ToLower(method)
+}
+
+func forbiddenMessage(a Attributes, reason string) string {
+	username := AnonymousUser
+	if a.User != nil {
+		username = a.User.Subject
+	}
+
+	message := fmt.Sprintf("User %q cannot %s path %q", username, a.Verb, a.Path)
+	if len(reason) != 0 {
+		message += ": " + reason
+	}
+
+	return message
+}
@@ -0,0 +1,122 @@
+package nelly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func decisionAuthorizer(decision Decision, reason string, err error) Authorizer {
+	return AuthorizerFunc(func(context.Context, Attributes) (Decision, string, error) {
+		return decision, reason, err
+	})
+}
+
+func TestUnionAuthorizer(t *testing.T) {
+	tests := []struct {
+		name        string
+		authorizers []Authorizer
+		decision    Decision
+		reason      string
+		err         bool
+	}{
+		{"empty", nil, DecisionNoOpinion, "", false},
+		{"allow", []Authorizer{
+			decisionAuthorizer(DecisionNoOpinion, "", nil),
+			decisionAuthorizer(DecisionAllow, "allowed", nil),
+			decisionAuthorizer(DecisionDeny, "denied", nil),
+		}, DecisionAllow, "allowed", false},
+		{"deny", []Authorizer{
+			decisionAuthorizer(DecisionDeny, "denied", nil),
+			decisionAuthorizer(DecisionAllow, "allowed", nil),
+		}, DecisionDeny, "denied", false},
+		{"no-opinion", []Authorizer{
+			decisionAuthorizer(DecisionNoOpinion, "first", nil),
+			decisionAuthorizer(DecisionNoOpinion, "second", errors.New("failed")),
+		}, DecisionNoOpinion, "first\nsecond", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision, reason, err := NewUnionAuthorizer(test.authorizers...).Authorize(context.Background(), Attributes{})
+			if decision != test.decision {
+				t.Errorf("expected decision %v, got %v", test.decision, decision)
+			}
+			if reason != test.reason {
+				t.Errorf("expected reason %q, got %q", test.reason, reason)
+			}
+			if (err != nil) != test.err {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestWithAuthorization(t *testing.T) {
+	var attributes Attributes
+	authorizer := AuthorizerFunc(func(ctx context.Context, a Attributes) (Decision, string, error) {
+		attributes = a
+		switch {
+		case a.User == nil:
+			return DecisionNoOpinion, "", nil
+		case a.Verb == "delete":
+			return DecisionDeny, "users can't delete", nil
+		case a.Params.ByName("id") == "error":
+			return DecisionNoOpinion, "", errors.New("policy engine is down")
+		}
+		return DecisionAllow, "", nil
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		user    *UserInfo
+		status  int
+		message string
+	}{
+		{"allow", http.MethodGet, "/v1/items/1", &UserInfo{Subject: "user"}, http.StatusOK, ""},
+		{"deny", http.MethodDelete, "/v1/items/1", &UserInfo{Subject: "user"}, http.StatusForbidden, `User "user" cannot delete path "/v1/items/1": users can't delete`},
+		{"no-opinion", http.MethodGet, "/v1/items/1", nil, http.StatusForbidden, `User "system:anonymous" cannot get path "/v1/items/1"`},
+		{"error", http.MethodPost, "/v1/items/error", &UserInfo{Subject: "user"}, http.StatusInternalServerError, "Failed to authorize request"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := httprouter.New()
+			router.Handle(test.method, "/v1/items/:id", NewChain(withTestUser(test.user), WithAuthorization(authorizer)).Then(
+				func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+			req, err := http.NewRequest(test.method, test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if attributes.Path != test.path || attributes.Params.ByName("id") != strings.TrimPrefix(test.path, "/v1/items/") {
+				t.Errorf("unexpected attributes %+v", attributes)
+			}
+
+			if test.message != "" {
+				var status restutil.Status
+				if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				if status.Message != test.message {
+					t.Errorf("expected message %q, got %q", test.message, status.Message)
+				}
+			}
+		})
+	}
+}
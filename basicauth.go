@@ -0,0 +1,212 @@
+package nelly
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/klog"
+)
+
+var errInvalidPassword = newTokenError("Invalid username or password")
+
+// BasicAuthStore checks the passwords of the users of WithBasicAuth
+type BasicAuthStore interface {
+	// Authenticate returns true if password is the password of the user
+	Authenticate(username string, password string) (bool, error)
+}
+
+// htpasswdEntry is the password hash of a user of an htpasswd file
+type htpasswdEntry []byte
+
+// matches returns true if password matches the hash
+func (e htpasswdEntry) matches(password string) bool {
+	if bytes.HasPrefix(e, []byte("{SHA}")) {
+		sum := sha1.Sum([]byte(password))
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare(e[len("{SHA}"):], []byte(hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword(e, []byte(password)) == nil
+}
+
+// parseHtpasswd parses the 'user:hash' lines of an htpasswd file. Only bcrypt
+// ($2y$, $2a$ and $2b$) and SHA-1 ({SHA}) hashes are supported.
+func parseHtpasswd(data []byte) (map[string]htpasswdEntry, error) {
+	entries := map[string]htpasswdEntry{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'user:hash'", line)
+		}
+		username, hash := text[:i], text[i+1:]
+
+		switch {
+		case strings.HasPrefix(hash, "{SHA}"):
+		case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("line %d: invalid bcrypt hash of user %q: %v", line, username, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unsupported hash of user %q, only bcrypt and SHA are supported", line, username)
+		}
+		entries[username] = htpasswdEntry(hash)
+	}
+
+	return entries, scanner.Err()
+}
+
+// dummyHtpasswdEntry returns a hash of the highest bcrypt cost of the entries,
+// or a SHA-1 hash if there is none. It's compared to the passwords of unknown
+// users, so they take as long to be rejected as the users of the file.
+func dummyHtpasswdEntry(entries map[string]htpasswdEntry) (htpasswdEntry, error) {
+	cost := 0
+	for _, entry := range entries {
+		if c, err := bcrypt.Cost(entry); err == nil && c > cost {
+			cost = c
+		}
+	}
+
+	if cost == 0 {
+		sum := sha1.Sum([]byte("dummy"))
+		return htpasswdEntry("{SHA}" + base64.StdEncoding.EncodeToString(sum[:])), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+	return htpasswdEntry(hash), err
+}
+
+// HtpasswdStore is a BasicAuthStore of the users of an Apache htpasswd file,
+// which is reloaded when it's modified. The passwords must be hashed with
+// bcrypt ('htpasswd -B') or SHA-1 ('htpasswd -s').
+type HtpasswdStore struct {
+	file *fileReloader
+
+	lock    sync.RWMutex
+	entries map[string]htpasswdEntry
+	// dummy is compared to the passwords of unknown users
+	dummy htpasswdEntry
+}
+
+// NewHtpasswdStore creates a new HtpasswdStore of the file at path, whose
+// modification time is checked at most once per checkPeriod (10 seconds if
+// zero). It fails if the file can't be read.
+func NewHtpasswdStore(path string, checkPeriod time.Duration) (*HtpasswdStore, error) {
+	s := &HtpasswdStore{}
+
+	file, err := newFileReloader(path, checkPeriod, s.parse)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// Reload reads the file if it was modified since it was last read. On
+// failure, the previously read users are kept.
+func (s *HtpasswdStore) Reload() error {
+	return s.file.reload()
+}
+
+// parse replaces the users of the store by the users of the file
+func (s *HtpasswdStore) parse(data []byte) error {
+	entries, err := parseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+	dummy, err := dummyHtpasswdEntry(entries)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = entries
+	s.dummy = dummy
+
+	return nil
+}
+
+// Authenticate implements BasicAuthStore
+func (s *HtpasswdStore) Authenticate(username string, password string) (bool, error) {
+	if err := s.file.reloadIfDue(); err != nil {
+		klog.Errorf("Failed to reload htpasswd file %s: %v", s.file.path, err)
+	}
+
+	s.lock.RLock()
+	entry, ok := s.entries[username]
+	dummy := s.dummy
+	s.lock.RUnlock()
+
+	if !ok {
+		dummy.matches(password)
+		return false, nil
+	}
+	return entry.matches(password), nil
+}
+
+// NewBasicAuthenticator returns an Authenticator that authenticates requests
+// with the username and password of the 'Authorization: Basic' header. The
+// Subject of the user is the username.
+func NewBasicAuthenticator(store BasicAuthStore) Authenticator {
+
+	if store == nil {
+		klog.Fatalf("Basic authentication requires a BasicAuthStore")
+	}
+
+	return AuthenticatorFunc(func(req *http.Request) (*UserInfo, bool, error) {
+		header := req.Header.Get("Authorization")
+		if len(header) < len("Basic ") || !strings.EqualFold(header[:len("Basic ")], "Basic ") {
+			return nil, false, nil
+		}
+
+		username, password, ok := req.BasicAuth()
+		if !ok {
+			return nil, false, &AuthError{Code: ErrorCodeInvalidRequest, Description: "Authorization header format must be Basic {credentials}"}
+		}
+
+		ok, err := store.Authenticate(username, password)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to authenticate user %q: %v", username, err)
+		}
+		if !ok {
+			return nil, false, errInvalidPassword
+		}
+
+		return &UserInfo{Subject: username, Extra: map[string]interface{}{}}, true, nil
+	})
+}
+
+// NewBasicErrorRenderer returns an ErrorRenderer that sets the RFC 7617
+// WWW-Authenticate header, e.g. 'Basic realm="admin", charset="UTF-8"', and
+// writes a JSON status body.
+func NewBasicErrorRenderer(realm string) ErrorRenderer {
+	header := `Basic realm="` + quotable(realm) + `", charset="UTF-8"`
+
+	return func(w http.ResponseWriter, r *http.Request, err *AuthError) {
+		if err.StatusCode() == http.StatusUnauthorized {
+			w.Header().Add("WWW-Authenticate", header)
+		}
+		writeAuthError(w, err)
+	}
+}
+
+// WithBasicAuth handler authenticates requests with HTTP Basic authentication
+// against the users of store, and sends a Basic challenge of realm on failure
+func WithBasicAuth(realm string, store BasicAuthStore) Handler {
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: NewBasicErrorRenderer(realm)}, NewBasicAuthenticator(store))
+}
@@ -0,0 +1,167 @@
+package nelly
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func htpasswdLine(t *testing.T, username string, password string, sha bool) string {
+	if sha {
+		sum := sha1.Sum([]byte(password))
+		return username + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return username + ":" + string(hash) + "\n"
+}
+
+func writeHtpasswd(t *testing.T, path string, modTime time.Time, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".htpasswd")
+	writeHtpasswd(t, path, time.Now(), "# admins\n"+
+		htpasswdLine(t, "alice", "alice-password", false)+
+		htpasswdLine(t, "bob", "bob-password", true))
+
+	store, err := NewHtpasswdStore(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var subject string
+	router := httprouter.New()
+	router.GET("/admin", WithBasicAuth("admin", store)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user, _ := UserFrom(r.Context())
+		subject = user.Subject
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		subject       string
+	}{
+		{"bcrypt", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:alice-password")), http.StatusOK, "alice"},
+		{"sha", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:bob-password")), http.StatusOK, "bob"},
+		{"wrong-password", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:bob-password")), http.StatusUnauthorized, ""},
+		{"unknown-user", "Basic " + base64.StdEncoding.EncodeToString([]byte("carol:alice-password")), http.StatusUnauthorized, ""},
+		{"malformed", "Basic alice", http.StatusBadRequest, ""},
+		{"no-credentials", "", http.StatusUnauthorized, ""},
+		{"bearer", "Bearer token", http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subject = ""
+
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if subject != test.subject {
+				t.Errorf("expected subject %q, got %q", test.subject, subject)
+			}
+
+			challenge := w.Header().Get("WWW-Authenticate")
+			if test.status == http.StatusUnauthorized && challenge != `Basic realm="admin", charset="UTF-8"` {
+				t.Errorf("unexpected challenge %q", challenge)
+			}
+		})
+	}
+}
+
+func TestHtpasswdStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".htpasswd")
+	now := time.Now()
+	writeHtpasswd(t, path, now.Add(-time.Hour), htpasswdLine(t, "alice", "password-1", true))
+
+	store, err := NewHtpasswdStore(path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok, _ := store.Authenticate("alice", "password-1"); !ok {
+		t.Errorf("expected password-1 to be valid")
+	}
+
+	writeHtpasswd(t, path, now, htpasswdLine(t, "alice", "password-2", false))
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := store.Authenticate("alice", "password-1"); ok {
+		t.Errorf("expected password-1 to be invalid after reload")
+	}
+	if ok, _ := store.Authenticate("alice", "password-2"); !ok {
+		t.Errorf("expected password-2 to be valid after reload")
+	}
+
+	// the users are kept if the file is invalid
+	writeHtpasswd(t, path, now.Add(time.Hour), "alice:$apr1$salt$hash\n")
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := store.Authenticate("alice", "password-2"); !ok {
+		t.Errorf("expected previous users to be kept")
+	}
+
+	for _, content := range []string{"alice\n", "alice:plain\n", "alice:$2y$invalid\n"} {
+		if _, err := parseHtpasswd([]byte(content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestDummyHtpasswdEntry(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("password"))
+	sha := htpasswdEntry("{SHA}" + base64.StdEncoding.EncodeToString(sum[:]))
+
+	// The dummy of bcrypt entries has their highest cost
+	dummy, err := dummyHtpasswdEntry(map[string]htpasswdEntry{"jane": htpasswdEntry(hash), "john": sha})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cost, err := bcrypt.Cost(dummy); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("expected dummy bcrypt hash of cost %d, got %d %v", bcrypt.MinCost+1, cost, err)
+	}
+
+	dummy, err = dummyHtpasswdEntry(map[string]htpasswdEntry{"john": sha})
+	if err != nil || string(dummy[:len("{SHA}")]) != "{SHA}" {
+		t.Errorf("expected dummy SHA hash, got %q %v", dummy, err)
+	}
+}
@@ -0,0 +1,52 @@
+package nelly
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache(2)
+	expiresAt := time.Now().Add(time.Hour)
+
+	cache.add("a", 1, expiresAt)
+	cache.add("b", 2, expiresAt)
+
+	// "a" is used, so "b" is the least recently used value
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Errorf("expected 1, got %v %v", value, ok)
+	}
+	cache.add("c", 3, expiresAt)
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if value, ok := cache.get("c"); !ok || value != 3 {
+		t.Errorf("expected 3, got %v %v", value, ok)
+	}
+	if cache.len() != 2 {
+		t.Errorf("expected 2 values, got %d", cache.len())
+	}
+
+	cache.add("a", 4, expiresAt)
+	if value, ok := cache.get("a"); !ok || value != 4 {
+		t.Errorf("expected 4, got %v %v", value, ok)
+	}
+
+	cache.remove("a")
+	if _, ok := cache.get("a"); ok {
+		t.Errorf("expected a to be removed")
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	cache := newLRUCache(2)
+
+	cache.add("expired", 1, time.Now().Add(-time.Second))
+	if _, ok := cache.get("expired"); ok {
+		t.Errorf("expected expired value not to be returned")
+	}
+	if cache.len() != 0 {
+		t.Errorf("expected expired value to be removed, got %d values", cache.len())
+	}
+}
@@ -0,0 +1,296 @@
+package nelly
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	errInvalidClientCert    = newTokenError("The client certificate isn't valid")
+	errClientCertNotAllowed = newTokenError("The client certificate isn't allowed")
+)
+
+// ClientCertOpts is the configuration that will be used by WithClientCertAuth and NewClientCertAuthenticator
+type ClientCertOpts struct {
+	// Roots is the pool of the CA certificates of the client certificates.
+	// Default: the chains verified by the TLS server (tls.Config.ClientCAs)
+	// are trusted
+	Roots *x509.CertPool
+	// AllowedSubjects are the CN, DNS, email or URI SANs of the allowed
+	// certificates. A trailing '*' matches any suffix, e.g.
+	// "spiffe://cluster.local/ns/billing/*". All the certificates are allowed
+	// if empty.
+	AllowedSubjects []string
+	// URISubject sets the Subject of the user to the first URI SAN of the
+	// certificate, e.g. its SPIFFE ID, instead of its CN
+	URISubject bool
+	// ForwardedCertHeader is the header in which a TLS terminating proxy
+	// forwards the client certificate, either an Envoy
+	// 'X-Forwarded-Client-Cert' element with a Cert field, or a URL-encoded
+	// PEM certificate (nginx $ssl_client_escaped_cert). The header is only
+	// read from TrustedProxies. Not read if empty.
+	ForwardedCertHeader string
+	// TrustedProxies are the IP addresses or CIDRs of the proxies whose
+	// ForwardedCertHeader is trusted
+	TrustedProxies []string
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated.
+	// Default: writes the JSON status without WWW-Authenticate challenge
+	ErrorRenderer ErrorRenderer
+}
+
+// clientCertAuthenticator authenticates requests with a client certificate
+type clientCertAuthenticator struct {
+	opts    ClientCertOpts
+	proxies []*net.IPNet
+}
+
+// NewClientCertAuthenticator returns an Authenticator that authenticates
+// requests with the client certificate of the TLS connection, or of the
+// forwarded header of a trusted proxy. The Subject of the user is the CN of
+// the certificate (or its first URI SAN) and its Groups are the O fields.
+func NewClientCertAuthenticator(opts ClientCertOpts) Authenticator {
+
+	var proxies []*net.IPNet
+	for _, proxy := range opts.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			klog.Fatalf("Invalid trusted proxy %q: %v", proxy, err)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	if opts.ForwardedCertHeader != "" && len(proxies) == 0 {
+		klog.Fatalf("Client certificate authentication with forwarded certificates requires TrustedProxies")
+	}
+
+	return &clientCertAuthenticator{opts: opts, proxies: proxies}
+}
+
+// AuthenticateRequest implements Authenticator
+func (a *clientCertAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	var cert *x509.Certificate
+	var err error
+
+	if a.opts.ForwardedCertHeader != "" && req.Header.Get(a.opts.ForwardedCertHeader) != "" && a.trustedProxy(req) {
+		cert, err = a.forwardedCert(req.Header.Get(a.opts.ForwardedCertHeader))
+	} else {
+		cert, err = a.tlsCert(req.TLS)
+	}
+	if err != nil {
+		return nil, false, &AuthError{Code: errInvalidClientCert.Code, Description: errInvalidClientCert.Description, Err: err}
+	}
+	if cert == nil {
+		return nil, false, nil
+	}
+
+	if !a.allowed(cert) {
+		return nil, false, errClientCertNotAllowed
+	}
+
+	user := &UserInfo{
+		Subject: cert.Subject.CommonName,
+		Groups:  cert.Subject.Organization,
+		Issuer:  cert.Issuer.String(),
+		Expiry:  cert.NotAfter,
+		Extra:   map[string]interface{}{},
+	}
+	if a.opts.URISubject {
+		if len(cert.URIs) == 0 {
+			return nil, false, &AuthError{Code: errInvalidClientCert.Code, Description: "The client certificate has no URI SAN"}
+		}
+		user.Subject = cert.URIs[0].String()
+	}
+
+	return user, true, nil
+}
+
+// tlsCert returns the verified client certificate of the TLS connection, nil
+// if there is none
+func (a *clientCertAuthenticator) tlsCert(state *tls.ConnectionState) (*x509.Certificate, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	if a.opts.Roots == nil {
+		if len(state.VerifiedChains) == 0 {
+			return nil, errors.New("client certificate wasn't verified by the TLS server")
+		}
+		return state.VerifiedChains[0][0], nil
+	}
+
+	return a.verify(state.PeerCertificates[0], state.PeerCertificates[1:])
+}
+
+// forwardedCert returns the client certificate of the forwarded header. It's
+// verified against opts.Roots if any, otherwise the proxy is trusted to have
+// verified it.
+func (a *clientCertAuthenticator) forwardedCert(header string) (*x509.Certificate, error) {
+	certPEM, chainPEM := header, ""
+	if !strings.HasPrefix(header, "-----") && !strings.HasPrefix(header, "%2D") {
+		// Envoy X-Forwarded-Client-Cert, the last element is added by the
+		// closest proxy
+		elements := splitQuoted(header, ',')
+		fields := map[string]string{}
+		for _, field := range splitQuoted(elements[len(elements)-1], ';') {
+			if i := strings.Index(field, "="); i > 0 {
+				fields[strings.ToLower(strings.TrimSpace(field[:i]))] = strings.Trim(strings.TrimSpace(field[i+1:]), `"`)
+			}
+		}
+		certPEM, chainPEM = fields["cert"], fields["chain"]
+		if certPEM == "" {
+			return nil, errors.New("forwarded client certificate has no Cert field")
+		}
+	}
+
+	certs, err := parseEscapedPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseEscapedPEM(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("forwarded client certificate has no certificate")
+	}
+
+	if a.opts.Roots == nil {
+		return certs[0], nil
+	}
+	return a.verify(certs[0], append(certs[1:], chain...))
+}
+
+// verify verifies cert against opts.Roots
+func (a *clientCertAuthenticator) verify(cert *x509.Certificate, intermediates []*x509.Certificate) (*x509.Certificate, error) {
+	verifyOpts := x509.VerifyOptions{
+		Roots:         a.opts.Roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, intermediate := range intermediates {
+		verifyOpts.Intermediates.AddCert(intermediate)
+	}
+
+	if _, err := cert.Verify(verifyOpts); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// trustedProxy returns true if the request is sent by a trusted proxy
+func (a *clientCertAuthenticator) trustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range a.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	klog.V(2).Infof("Ignoring %s header of untrusted proxy %s", a.opts.ForwardedCertHeader, host)
+	return false
+}
+
+// allowed returns true if the CN or a SAN of cert is in opts.AllowedSubjects
+func (a *clientCertAuthenticator) allowed(cert *x509.Certificate) bool {
+	if len(a.opts.AllowedSubjects) == 0 {
+		return true
+	}
+
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, allowed := range a.opts.AllowedSubjects {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if allowed == name || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseEscapedPEM parses the certificates of a URL-encoded PEM document
+func parseEscapedPEM(escaped string) ([]*x509.Certificate, error) {
+	data, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// splitQuoted splits s around sep, except within double quotes
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// WithClientCertAuth handler authenticates requests with client certificates (mTLS),
+// see NewClientCertAuthenticator
+func WithClientCertAuth(opts ClientCertOpts) Handler {
+	renderer := opts.ErrorRenderer
+	if renderer == nil {
+		renderer = func(w http.ResponseWriter, r *http.Request, err *AuthError) {
+			writeAuthError(w, err)
+		}
+	}
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: renderer}, NewClientCertAuthenticator(opts))
+}
@@ -0,0 +1,179 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, org string, uri string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{org}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, _ := url.Parse(uri)
+		template.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func escapedPEM(cert *x509.Certificate) string {
+	return url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	ca := newTestCA(t, "mesh-ca")
+	otherCA := newTestCA(t, "other-ca")
+
+	billing := ca.issue(t, "billing", "payments", "spiffe://cluster.local/ns/billing/sa/api")
+	orders := ca.issue(t, "orders", "shop", "spiffe://cluster.local/ns/orders/sa/api")
+	untrusted := otherCA.issue(t, "billing", "payments", "spiffe://cluster.local/ns/billing/sa/api")
+
+	tests := []struct {
+		name       string
+		opts       ClientCertOpts
+		tls        *tls.ConnectionState
+		remoteAddr string
+		header     string
+		ok         bool
+		err        bool
+		subject    string
+	}{
+		{"no-cert", ClientCertOpts{}, nil, "", "", false, false, ""},
+		{"verified-chain", ClientCertOpts{},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}, VerifiedChains: [][]*x509.Certificate{{billing, ca.cert}}}, "", "", true, false, "billing"},
+		{"not-verified", ClientCertOpts{},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}, "", "", false, true, ""},
+		{"roots", ClientCertOpts{Roots: ca.pool()},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}, "", "", true, false, "billing"},
+		{"other-roots", ClientCertOpts{Roots: ca.pool()},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{untrusted}}, "", "", false, true, ""},
+		{"uri-subject", ClientCertOpts{Roots: ca.pool(), URISubject: true},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}, "", "", true, false, "spiffe://cluster.local/ns/billing/sa/api"},
+		{"allowed-uri", ClientCertOpts{Roots: ca.pool(), AllowedSubjects: []string{"spiffe://cluster.local/ns/billing/*"}},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}, "", "", true, false, "billing"},
+		{"not-allowed", ClientCertOpts{Roots: ca.pool(), AllowedSubjects: []string{"spiffe://cluster.local/ns/billing/*"}},
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{orders}}, "", "", false, true, ""},
+		{"xfcc", ClientCertOpts{Roots: ca.pool(), ForwardedCertHeader: "X-Forwarded-Client-Cert", TrustedProxies: []string{"10.0.0.0/8"}},
+			nil, "10.0.0.1:1234", `By=spiffe://cluster.local/ns/gateway;Hash=abc;Subject="CN=orders,O=shop";Cert="` + escapedPEM(orders) + `"`, true, false, "orders"},
+		{"xfcc-last-element", ClientCertOpts{ForwardedCertHeader: "X-Forwarded-Client-Cert", TrustedProxies: []string{"10.0.0.1"}},
+			nil, "10.0.0.1:1234", `Cert="` + escapedPEM(billing) + `",Subject="CN=orders,O=shop";Cert="` + escapedPEM(orders) + `"`, true, false, "orders"},
+		{"xfcc-other-roots", ClientCertOpts{Roots: ca.pool(), ForwardedCertHeader: "X-Forwarded-Client-Cert", TrustedProxies: []string{"10.0.0.0/8"}},
+			nil, "10.0.0.1:1234", `Cert="` + escapedPEM(untrusted) + `"`, false, true, ""},
+		{"escaped-pem", ClientCertOpts{Roots: ca.pool(), ForwardedCertHeader: "X-SSL-Client-Cert", TrustedProxies: []string{"10.0.0.0/8"}},
+			nil, "10.0.0.1:1234", escapedPEM(billing), true, false, "billing"},
+		{"untrusted-proxy", ClientCertOpts{ForwardedCertHeader: "X-SSL-Client-Cert", TrustedProxies: []string{"10.0.0.0/8"}},
+			nil, "192.168.0.1:1234", escapedPEM(billing), false, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+			req.TLS = test.tls
+			if test.remoteAddr != "" {
+				req.RemoteAddr = test.remoteAddr
+			}
+			if test.header != "" {
+				req.Header.Set(test.opts.ForwardedCertHeader, test.header)
+			}
+
+			user, ok, err := NewClientCertAuthenticator(test.opts).AuthenticateRequest(req)
+			if ok != test.ok || (err != nil) != test.err {
+				t.Fatalf("expected %v and error %v, got %v and %v", test.ok, test.err, ok, err)
+			}
+			if ok && user.Subject != test.subject {
+				t.Errorf("expected subject %q, got %q", test.subject, user.Subject)
+			}
+		})
+	}
+}
+
+func TestWithClientCertAuth(t *testing.T) {
+	ca := newTestCA(t, "mesh-ca")
+	billing := ca.issue(t, "billing", "payments", "")
+
+	var groups []string
+	router := httprouter.New()
+	router.GET("/v1", WithClientCertAuth(ClientCertOpts{Roots: ca.pool()})(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user, _ := UserFrom(r.Context())
+		groups = user.Groups
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(groups) != 1 || groups[0] != "payments" {
+		t.Errorf("expected user of group payments, got %v %v", w.Code, groups)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("expected status 401 without challenge, got %v %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,290 @@
+package nelly
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/pharmatics/rest-util"
+)
+
+var (
+	errCSRFTokenNotFound = errors.New("CSRF token not found")
+	errInvalidCSRFToken  = errors.New("The CSRF token isn't valid")
+	errUntrustedOrigin   = errors.New("The request origin isn't trusted")
+)
+
+type csrfTokenContextKeyType int
+
+// csrfTokenKey is used to store the CSRF token of the request
+const csrfTokenKey csrfTokenContextKeyType = iota
+
+// CSRFTokenFrom returns the CSRF token of the request, e.g. to render it in
+// a form field or a meta tag of a page
+func CSRFTokenFrom(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(csrfTokenKey).(string)
+	return token, ok
+}
+
+// CSRFOpts is the configuration that will be used by WithCSRF
+type CSRFOpts struct {
+	// Secrets are the secrets the tokens are signed with. The first secret
+	// signs the new tokens, the others are the previous secrets during a
+	// rotation.
+	Secrets []string
+	// CookieName is the name of the cookie of the token.
+	// Default: "csrf_token"
+	CookieName string
+	// CookiePath is the path of the cookie.
+	// Default: "/"
+	CookiePath string
+	// CookieDomain is the domain of the cookie, it's a host-only cookie if empty
+	CookieDomain string
+	// CookieSecure sends the cookie over HTTPS only
+	CookieSecure bool
+	// CookieHTTPOnly hides the cookie from JavaScript, the token must then be
+	// rendered in the pages, see CSRFTokenFrom
+	CookieHTTPOnly bool
+	// CookieSameSite is the SameSite attribute of the cookie.
+	// Default: http.SameSiteLaxMode
+	CookieSameSite http.SameSite
+	// MaxAge is the lifetime of the tokens, they are rotated by the requests
+	// with a safe method after half of it.
+	// Default: 12 hours
+	MaxAge time.Duration
+	// Header is the header of the token sent by the requests with an unsafe method.
+	// Default: "X-CSRF-Token"
+	Header string
+	// FormField is the form field of the token, if the request has no Header.
+	// Default: "csrf_token"
+	FormField string
+	// TrustedOrigins are the origins other than the request host that may send
+	// requests with an unsafe method, e.g. "https://app.example.com"
+	TrustedOrigins []string
+	// SessionID returns the identifier of the session of the request, e.g. its
+	// session ID or user subject, which the tokens are bound to. A token
+	// issued to another session isn't valid. The tokens aren't bound to a
+	// session if nil.
+	SessionID func(req *http.Request) string
+}
+
+// csrfToken is a parsed token '<nonce>.<issued at>.<signature>'
+type csrfToken struct {
+	value    string
+	issuedAt time.Time
+}
+
+// signCSRFToken returns the HMAC-SHA256 of '<session ID>!<nonce>.<issued at>'
+func signCSRFToken(secret string, sessionID string, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionID + "!" + payload))
+	return mac.Sum(nil)
+}
+
+// newCSRFToken returns a new token of the session signed with the first secret
+func newCSRFToken(opts CSRFOpts, sessionID string, now time.Time) (*csrfToken, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(nonce) + "." + strconv.FormatInt(now.Unix(), 10)
+	signature := base64.RawURLEncoding.EncodeToString(signCSRFToken(opts.Secrets[0], sessionID, payload))
+
+	return &csrfToken{value: payload + "." + signature, issuedAt: time.Unix(now.Unix(), 0)}, nil
+}
+
+// parseCSRFToken verifies the signature, the session and the expiry of the token
+func parseCSRFToken(opts CSRFOpts, sessionID string, value string, now time.Time) (*csrfToken, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil, errInvalidCSRFToken
+	}
+	payload := value[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, errInvalidCSRFToken
+	}
+
+	verified := false
+	for _, secret := range opts.Secrets {
+		if hmac.Equal(signCSRFToken(secret, sessionID, payload), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errInvalidCSRFToken
+	}
+
+	seconds, err := strconv.ParseInt(payload[strings.LastIndex(payload, ".")+1:], 10, 64)
+	if err != nil {
+		return nil, errInvalidCSRFToken
+	}
+	issuedAt := time.Unix(seconds, 0)
+	if !now.Before(issuedAt.Add(opts.MaxAge)) {
+		return nil, errInvalidCSRFToken
+	}
+
+	return &csrfToken{value: value, issuedAt: issuedAt}, nil
+}
+
+// isSafeMethod checks whether the method is safe (RFC 7231 section 4.2.1)
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// trustedOrigin checks that the Origin header of the request, or the origin of
+// its Referer header, is the request host or one of the trusted origins. The
+// requests without both headers are trusted, they are checked by the token.
+func trustedOrigin(req *http.Request, trustedOrigins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		referer := req.Header.Get("Referer")
+		if referer == "" {
+			return true
+		}
+		u, err := url.Parse(referer)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, trusted := range trustedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(trusted, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithCSRF handler protects the requests with an unsafe method against
+// Cross-Site Request Forgery with the signed double-submit cookie pattern.
+// The requests with a safe method are issued a token in a cookie, which is
+// rotated after half of MaxAge. The requests with an unsafe method must send
+// the token of their cookie in the Header or the FormField, and their Origin
+// or Referer header must be the request host or one of the trusted origins.
+// Otherwise, the handler will return StatusForbidden. The tokens are bound to
+// the session of the request if SessionID is set. The token of the request is
+// stored in the request context, see CSRFTokenFrom.
+func WithCSRF(opts CSRFOpts) Handler {
+
+	if len(opts.Secrets) == 0 {
+		klog.Fatalf("CSRF protection requires at least one secret")
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "csrf_token"
+	}
+	if opts.CookiePath == "" {
+		opts.CookiePath = "/"
+	}
+	if opts.CookieSameSite == 0 {
+		opts.CookieSameSite = http.SameSiteLaxMode
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 12 * time.Hour
+	}
+	if opts.Header == "" {
+		opts.Header = "X-CSRF-Token"
+	}
+	if opts.FormField == "" {
+		opts.FormField = "csrf_token"
+	}
+
+	forbidden := func(w http.ResponseWriter, err error) {
+		statusErr := restutil.Error(err.Error(), restutil.StatusReasonForbidden)
+		restutil.ResponseJSON(statusErr, w, statusErr.Code)
+	}
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			now := time.Now()
+			sessionID := ""
+			if opts.SessionID != nil {
+				sessionID = opts.SessionID(req)
+			}
+
+			var token *csrfToken
+			if cookie, err := req.Cookie(opts.CookieName); err == nil {
+				token, _ = parseCSRFToken(opts, sessionID, cookie.Value, now)
+			}
+
+			if isSafeMethod(req.Method) {
+				if token == nil || now.Sub(token.issuedAt) >= opts.MaxAge/2 {
+					var err error
+					token, err = newCSRFToken(opts, sessionID, now)
+					if err != nil {
+						klog.Errorf("Failed to issue CSRF token of %v %v: %v", req.Method, req.URL.Path, err)
+						statusErr := restutil.Error("Failed to issue CSRF token", restutil.StatusReasonInternalError)
+						restutil.ResponseJSON(statusErr, w, statusErr.Code)
+						return
+					}
+
+					http.SetCookie(w, &http.Cookie{
+						Name:     opts.CookieName,
+						Value:    token.value,
+						Path:     opts.CookiePath,
+						Domain:   opts.CookieDomain,
+						MaxAge:   int(opts.MaxAge / time.Second),
+						Secure:   opts.CookieSecure,
+						HttpOnly: opts.CookieHTTPOnly,
+						SameSite: opts.CookieSameSite,
+					})
+				}
+			} else {
+				if !trustedOrigin(req, opts.TrustedOrigins) {
+					klog.V(4).Infof("Untrusted origin: %v %v, Origin: %q, Referer: %q", req.Method, req.URL.Path, req.Header.Get("Origin"), req.Header.Get("Referer"))
+					forbidden(w, errUntrustedOrigin)
+					return
+				}
+
+				submitted := req.Header.Get(opts.Header)
+				if submitted == "" {
+					submitted = req.PostFormValue(opts.FormField)
+				}
+				if submitted == "" {
+					forbidden(w, errCSRFTokenNotFound)
+					return
+				}
+				if token == nil || subtle.ConstantTimeCompare([]byte(submitted), []byte(token.value)) != 1 {
+					forbidden(w, errInvalidCSRFToken)
+					return
+				}
+			}
+
+			req = req.WithContext(context.WithValue(req.Context(), csrfTokenKey, token.value))
+
+			h(w, req, p)
+		}
+	}
+
+	return fn
+}
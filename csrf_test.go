@@ -0,0 +1,162 @@
+package nelly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestWithCSRF(t *testing.T) {
+	opts := CSRFOpts{Secrets: []string{"current", "previous"}, TrustedOrigins: []string{"https://app.example.com"}}
+	withCSRF := WithCSRF(opts)
+
+	var token string
+	handle := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		token, _ = CSRFTokenFrom(r.Context())
+	}
+	router := httprouter.New()
+	router.GET("/form", withCSRF(handle))
+	router.POST("/form", withCSRF(handle))
+
+	now := time.Now()
+	opts.MaxAge = 12 * time.Hour
+	current, _ := newCSRFToken(opts, "", now)
+	old, _ := newCSRFToken(opts, "", now.Add(-7*time.Hour))
+	expired, _ := newCSRFToken(opts, "", now.Add(-13*time.Hour))
+	previous, _ := newCSRFToken(CSRFOpts{Secrets: []string{"previous"}}, "", now)
+	forged, _ := newCSRFToken(CSRFOpts{Secrets: []string{"other"}}, "", now)
+
+	tests := []struct {
+		name    string
+		method  string
+		cookie  string
+		headers map[string]string
+		form    url.Values
+		status  int
+		issued  bool
+		message string
+	}{
+		{"issue", http.MethodGet, "", nil, nil, http.StatusOK, true, ""},
+		{"keep", http.MethodGet, current.value, nil, nil, http.StatusOK, false, ""},
+		{"rotate", http.MethodGet, old.value, nil, nil, http.StatusOK, true, ""},
+		{"reissue-expired", http.MethodGet, expired.value, nil, nil, http.StatusOK, true, ""},
+		{"reissue-forged", http.MethodGet, forged.value, nil, nil, http.StatusOK, true, ""},
+		{"header", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value}, nil, http.StatusOK, false, ""},
+		{"form-field", http.MethodPost, current.value, nil, url.Values{"csrf_token": {current.value}}, http.StatusOK, false, ""},
+		{"previous-secret", http.MethodPost, previous.value, map[string]string{"X-CSRF-Token": previous.value}, nil, http.StatusOK, false, ""},
+		{"same-origin", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value, "Origin": "http://example.com"}, nil, http.StatusOK, false, ""},
+		{"trusted-origin", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value, "Origin": "https://app.example.com"}, nil, http.StatusOK, false, ""},
+		{"trusted-referer", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value, "Referer": "https://app.example.com/page"}, nil, http.StatusOK, false, ""},
+		{"untrusted-origin", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value, "Origin": "https://evil.com"}, nil,
+			http.StatusForbidden, false, "The request origin isn't trusted"},
+		{"untrusted-referer", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": current.value, "Referer": "https://evil.com/page"}, nil,
+			http.StatusForbidden, false, "The request origin isn't trusted"},
+		{"no-token", http.MethodPost, current.value, nil, nil, http.StatusForbidden, false, "CSRF token not found"},
+		{"no-cookie", http.MethodPost, "", map[string]string{"X-CSRF-Token": current.value}, nil, http.StatusForbidden, false, "The CSRF token isn't valid"},
+		{"mismatch", http.MethodPost, current.value, map[string]string{"X-CSRF-Token": old.value}, nil, http.StatusForbidden, false, "The CSRF token isn't valid"},
+		{"expired", http.MethodPost, expired.value, map[string]string{"X-CSRF-Token": expired.value}, nil, http.StatusForbidden, false, "The CSRF token isn't valid"},
+		{"forged", http.MethodPost, forged.value, map[string]string{"X-CSRF-Token": forged.value}, nil, http.StatusForbidden, false, "The CSRF token isn't valid"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token = ""
+
+			var req *http.Request
+			if test.form != nil {
+				req = httptest.NewRequest(test.method, "/form", strings.NewReader(test.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(test.method, "/form", nil)
+			}
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "csrf_token", Value: test.cookie})
+			}
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if test.status != http.StatusOK {
+				var status restutil.Status
+				if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if status.Message != test.message {
+					t.Errorf("expected message %q, got %q", test.message, status.Message)
+				}
+				return
+			}
+
+			cookies := w.Result().Cookies()
+			if !test.issued {
+				if len(cookies) != 0 {
+					t.Errorf("expected no cookie, got %v", cookies)
+				}
+				if token != test.cookie {
+					t.Errorf("expected token %q, got %q", test.cookie, token)
+				}
+				return
+			}
+
+			if len(cookies) != 1 || cookies[0].Name != "csrf_token" {
+				t.Fatalf("expected csrf_token cookie, got %v", cookies)
+			}
+			if cookies[0].Value == test.cookie || cookies[0].Value != token {
+				t.Errorf("expected new token %q in context, got %q", cookies[0].Value, token)
+			}
+			if cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].MaxAge != int((12*time.Hour)/time.Second) {
+				t.Errorf("unexpected cookie attributes %+v", cookies[0])
+			}
+			if _, err := parseCSRFToken(opts, "", cookies[0].Value, time.Now()); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithCSRFSessionID(t *testing.T) {
+	opts := CSRFOpts{Secrets: []string{"secret"}, SessionID: func(r *http.Request) string { return r.Header.Get("X-Test-Session") }}
+
+	router := httprouter.New()
+	router.POST("/form", WithCSRF(opts)(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	opts.MaxAge = 12 * time.Hour
+	token, _ := newCSRFToken(opts, "jane", time.Now())
+
+	tests := []struct {
+		name    string
+		session string
+		status  int
+	}{
+		{"same-session", "jane", http.StatusOK},
+		{"other-session", "john", http.StatusForbidden},
+		{"no-session", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/form", nil)
+			req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token.value})
+			req.Header.Set("X-CSRF-Token", token.value)
+			req.Header.Set("X-Test-Session", test.session)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package nelly
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// dpopScheme is the Authorization scheme of DPoP-bound tokens (RFC 9449)
+const dpopScheme = "DPoP"
+
+var (
+	errDPoPProofNotFound        = newDPoPProofError("DPoP proof not found")
+	errInvalidDPoPProof         = newDPoPProofError("The DPoP proof isn't valid")
+	errExpiredDPoPProof         = newDPoPProofError("The DPoP proof is expired")
+	errReplayedDPoPProof        = newDPoPProofError("The DPoP proof has already been used")
+	errDPoPProofRequestMismatch = newDPoPProofError("The DPoP proof doesn't match the request")
+	errDPoPProofTokenMismatch   = newDPoPProofError("The DPoP proof doesn't match the token")
+	errDPoPBoundToken           = newTokenError("The token is bound to a DPoP key and must be sent with the DPoP scheme")
+	errDPoPUnboundToken         = newTokenError("The token isn't bound to a DPoP key")
+	errDPoPNotAccepted          = newTokenError("DPoP tokens are not accepted")
+)
+
+// newDPoPProofError returns an invalid_dpop_proof AuthError with the given description
+func newDPoPProofError(description string) *AuthError {
+	return &AuthError{Code: ErrorCodeInvalidDPoPProof, Description: description}
+}
+
+// dpopExtractor extracts the token from the 'Authorization: DPoP {token}' header
+var dpopExtractor = FromHeader("Authorization", dpopScheme)
+
+// dpopParser parses the proofs, their claims are validated by DPoPOpts
+var dpopParser = &jwt.Parser{SkipClaimsValidation: true}
+
+// DPoPOpts configures the validation of the DPoP proofs (RFC 9449) of the
+// tokens sent with the 'Authorization: DPoP {token}' header
+type DPoPOpts struct {
+	// Enabled accepts the tokens sent with the DPoP scheme and a 'DPoP' proof
+	// header. The tokens bound to a key ('cnf.jkt' claim) are then only
+	// accepted with a valid proof of that key.
+	// Default: false
+	Enabled bool
+	// Required rejects the tokens that are not bound to a key.
+	// Default: false (bearer tokens are accepted)
+	Required bool
+	// Algorithms is the set of allowed signing algorithms of the proofs.
+	// Default: ES256, ES384, ES512, RS256, PS256 and EdDSA
+	Algorithms []string
+	// MaxAge is the maximum time since the proof was created ('iat' claim).
+	// Default: 1 minute
+	MaxAge time.Duration
+	// Leeway is the allowed clock skew of the proofs created in the future.
+	// Default: 5 seconds
+	Leeway time.Duration
+	// NonceStore records the 'jti' claim of the proofs, the proofs whose jti
+	// was already received are rejected.
+	// Default: NewMemoryNonceStore()
+	NonceStore NonceStore
+}
+
+func dpopOptsWithDefaults(opts DPoPOpts) DPoPOpts {
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{"ES256", "ES384", "ES512", "RS256", "PS256", SigningMethodEdDSA.Alg()}
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Minute
+	}
+	if opts.Leeway <= 0 {
+		opts.Leeway = 5 * time.Second
+	}
+	if opts.NonceStore == nil {
+		opts.NonceStore = NewMemoryNonceStore()
+	}
+	return opts
+}
+
+// dpopProof is a validated DPoP proof
+type dpopProof struct {
+	// jkt is the JWK thumbprint of the proof key
+	jkt       string
+	jti       string
+	expiresAt time.Time
+}
+
+// verifyRequest checks that the token is sent with a valid proof of the key
+// it is bound to, if any
+func (o DPoPOpts) verifyRequest(req *http.Request, token string, dpop bool, id tokenID, now time.Time) error {
+	if id.jkt == "" {
+		if dpop || o.Required {
+			return errDPoPUnboundToken
+		}
+		return nil
+	}
+	if !dpop {
+		return errDPoPBoundToken
+	}
+
+	proof, err := o.verifyProof(req, token, now)
+	if err != nil {
+		return err
+	}
+	if proof.jkt != id.jkt {
+		return errDPoPProofTokenMismatch
+	}
+
+	// The jti is unique per key
+	ok, err := o.NonceStore.Use(proof.jkt+":"+proof.jti, proof.expiresAt)
+	if err != nil {
+		klog.Errorf("Failed to check replay of DPoP proof of %v %v: %v", req.Method, req.URL.Path, err)
+		return errors.New("Failed to check DPoP proof replay")
+	}
+	if !ok {
+		return errReplayedDPoPProof
+	}
+
+	return nil
+}
+
+// verifyProof validates the signature and the claims of the DPoP proof of
+// the request (RFC 9449 section 4.3)
+func (o DPoPOpts) verifyProof(req *http.Request, token string, now time.Time) (*dpopProof, error) {
+	headers := req.Header.Values(dpopScheme)
+	if len(headers) == 0 {
+		return nil, errDPoPProofNotFound
+	}
+	if len(headers) != 1 {
+		return nil, errInvalidDPoPProof
+	}
+
+	proof := &dpopProof{}
+	parsed, err := dpopParser.Parse(headers[0], func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("Unexpected DPoP proof type %q", typ)
+		}
+		if !algorithmAllowed(o.Algorithms, t.Method.Alg()) {
+			return nil, fmt.Errorf("Unexpected signing method %s", t.Method.Alg())
+		}
+
+		jwk, err := proofKey(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if !keyMatchesAlgorithm(key, t.Method.Alg()) {
+			return nil, fmt.Errorf("DPoP proof key can't be used with %s signing method", t.Method.Alg())
+		}
+
+		proof.jkt, err = jwkThumbprint(jwk)
+		return key, err
+	})
+	if err != nil || !parsed.Valid {
+		klog.V(4).Infof("Invalid DPoP proof of %v %v: %v", req.Method, req.URL.Path, err)
+		return nil, errInvalidDPoPProof
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+	proof.jti, _ = claims["jti"].(string)
+	if proof.jti == "" {
+		return nil, errInvalidDPoPProof
+	}
+
+	htm, _ := claims["htm"].(string)
+	htu, _ := claims["htu"].(string)
+	if htm != req.Method || !requestURLMatches(req, htu) {
+		return nil, errDPoPProofRequestMismatch
+	}
+
+	iat := claimTime(claims["iat"])
+	if iat.IsZero() {
+		return nil, errInvalidDPoPProof
+	}
+	proof.expiresAt = iat.Add(o.MaxAge)
+	if !now.Before(proof.expiresAt) || iat.After(now.Add(o.Leeway)) {
+		return nil, errExpiredDPoPProof
+	}
+
+	if ath, _ := claims["ath"].(string); ath != accessTokenHash(token) {
+		return nil, errDPoPProofTokenMismatch
+	}
+
+	return proof, nil
+}
+
+// proofKey returns the public JSON Web Key of the 'jwk' header of a proof
+func proofKey(header interface{}) (JSONWebKeys, error) {
+	var jwk JSONWebKeys
+
+	members, ok := header.(map[string]interface{})
+	if !ok {
+		return jwk, errors.New("DPoP proof has no jwk header")
+	}
+	if _, ok := members["d"]; ok {
+		return jwk, errors.New("DPoP proof jwk header is a private key")
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return jwk, err
+	}
+	err = json.Unmarshal(data, &jwk)
+
+	return jwk, err
+}
+
+// jwkThumbprint returns the base64url encoded SHA-256 JWK thumbprint of the
+// key (RFC 7638), i.e. the hash of its required members in lexicographic order
+func jwkThumbprint(jwk JSONWebKeys) (string, error) {
+	var members map[string]string
+	switch jwk.Kty {
+	case "RSA":
+		members = map[string]string{"e": jwk.E, "kty": jwk.Kty, "n": jwk.N}
+	case "EC":
+		members = map[string]string{"crv": jwk.Crv, "kty": jwk.Kty, "x": jwk.X, "y": jwk.Y}
+	case "OKP":
+		members = map[string]string{"crv": jwk.Crv, "kty": jwk.Kty, "x": jwk.X}
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	for name, value := range members {
+		if value == "" {
+			return "", fmt.Errorf("the key has no %q member", name)
+		}
+	}
+
+	// The keys of maps are marshalled in lexicographic order
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// accessTokenHash returns the 'ath' claim of the proofs of token
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// requestURLMatches checks that htu is the URL of the request without query
+// and fragment. The scheme is the one of the X-Forwarded-Proto header, if
+// the TLS connection is terminated by a proxy.
+func requestURLMatches(req *http.Request, htu string) bool {
+	expected, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	actual := &url.URL{Scheme: scheme, Host: req.Host, Path: req.URL.Path}
+
+	return normalizedURL(expected) == normalizedURL(actual)
+}
+
+// normalizedURL returns the scheme, host and path of u with the syntax and
+// scheme-based normalization of RFC 3986 section 6.2
+func normalizedURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	} else if scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + host + path
+}
+
+// isDPoPRequest checks whether the token of the request is sent with the DPoP scheme
+func isDPoPRequest(req *http.Request) bool {
+	fields := strings.Fields(req.Header.Get("Authorization"))
+	return len(fields) != 0 && strings.EqualFold(fields[0], dpopScheme)
+}
+
+// NewDPoPErrorRenderer returns an ErrorRenderer that sets the DPoP
+// WWW-Authenticate challenge of RFC 9449 with the algorithms of opts, e.g.
+// 'DPoP realm="api", error="invalid_dpop_proof", algs="ES256 EdDSA"'. If the
+// bearer tokens are accepted, a Bearer challenge is added and the errors of
+// the bearer tokens are sent in it.
+func NewDPoPErrorRenderer(realm string, opts DPoPOpts) ErrorRenderer {
+	opts = dpopOptsWithDefaults(opts)
+	algs := `algs="` + strings.Join(opts.Algorithms, " ") + `"`
+
+	return func(w http.ResponseWriter, r *http.Request, err *AuthError) {
+		dpopErr, bearerErr := err, &AuthError{}
+		if !opts.Required && !isDPoPRequest(r) && err.Code != ErrorCodeInvalidDPoPProof && err != errDPoPBoundToken {
+			dpopErr, bearerErr = &AuthError{}, err
+		}
+
+		dpopChallenge := challenge(dpopScheme, realm, dpopErr)
+		if dpopChallenge == dpopScheme {
+			dpopChallenge += " " + algs
+		} else {
+			dpopChallenge += ", " + algs
+		}
+		w.Header().Add("WWW-Authenticate", dpopChallenge)
+		if !opts.Required {
+			w.Header().Add("WWW-Authenticate", challenge("Bearer", realm, bearerErr))
+		}
+
+		writeAuthError(w, err)
+	}
+}
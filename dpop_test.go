@@ -0,0 +1,161 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+// signTestProof signs a DPoP proof of the request with key, its claims
+// override the claims of a valid proof of token
+func signTestProof(t *testing.T, key *ecdsa.PrivateKey, method string, htu string, token string, claims jwt.MapClaims) string {
+	proof := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": time.Now().String(),
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+		"ath": accessTokenHash(token),
+	})
+	for name, value := range claims {
+		proof.Claims.(jwt.MapClaims)[name] = value
+	}
+	proof.Header["typ"] = "dpop+jwt"
+	proof.Header["jwk"] = testJWK("", &key.PublicKey)
+
+	signed, err := proof.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638 section 3.1
+	jwk := JSONWebKeys{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-" +
+			"5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-" +
+			"bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+
+	thumbprint, err := jwkThumbprint(jwk)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("unexpected thumbprint %q", thumbprint)
+	}
+}
+
+func TestWithAuthDPoP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, err := jwkThumbprint(testJWK("", &key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := AuthOpts{Keys: HMACSecret("secret"), DPoP: DPoPOpts{Enabled: true, Algorithms: []string{"ES256"}}}
+	router := httprouter.New()
+	router.GET("/v1", WithAuth(opts)(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+	opts.DPoP.Required = true
+	router.GET("/v1/required", WithAuth(opts)(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	bound := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "jane", "cnf": map[string]interface{}{"jkt": jkt}})
+	bearer := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "jane"})
+	htu := "http://example.com/v1"
+	replayed := signTestProof(t, key, http.MethodGet, htu, bound, nil)
+
+	// The private key members of the proof jwk header
+	privateProof := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": "private", "htm": http.MethodGet, "htu": htu, "iat": time.Now().Unix(), "ath": accessTokenHash(bound),
+	})
+	privateJWK := testJWK("", &key.PublicKey)
+	privateProof.Header["typ"] = "dpop+jwt"
+	privateProof.Header["jwk"] = map[string]interface{}{"kty": privateJWK.Kty, "crv": privateJWK.Crv, "x": privateJWK.X, "y": privateJWK.Y, "d": jwt.EncodeSegment(key.D.Bytes())}
+	private, err := privateProof.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		proof         string
+		status        int
+		challenges    []string
+	}{
+		{"dpop", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, htu, bound, nil), http.StatusOK, nil},
+		{"first", "/v1", "DPoP " + bound, replayed, http.StatusOK, nil},
+		{"replayed", "/v1", "DPoP " + bound, replayed, http.StatusUnauthorized, []string{
+			`DPoP error="invalid_dpop_proof", error_description="The DPoP proof has already been used", algs="ES256"`, "Bearer"}},
+		{"bearer", "/v1", "Bearer " + bearer, "", http.StatusOK, nil},
+		{"no-token", "/v1", "", "", http.StatusUnauthorized, []string{`DPoP algs="ES256"`, "Bearer"}},
+		{"bound-bearer", "/v1", "Bearer " + bound, "", http.StatusUnauthorized, []string{
+			`DPoP error="invalid_token", error_description="The token is bound to a DPoP key and must be sent with the DPoP scheme", algs="ES256"`, "Bearer"}},
+		{"unbound-dpop", "/v1", "DPoP " + bearer, signTestProof(t, key, http.MethodGet, htu, bearer, nil), http.StatusUnauthorized, []string{
+			`DPoP error="invalid_token", error_description="The token isn't bound to a DPoP key", algs="ES256"`, "Bearer"}},
+		{"required", "/v1/required", "Bearer " + bearer, "", http.StatusUnauthorized, []string{
+			`DPoP error="invalid_token", error_description="The token isn't bound to a DPoP key", algs="ES256"`}},
+		{"no-proof", "/v1", "DPoP " + bound, "", http.StatusUnauthorized, nil},
+		{"other-key", "/v1", "DPoP " + bound, signTestProof(t, otherKey, http.MethodGet, htu, bound, nil), http.StatusUnauthorized, nil},
+		{"other-method", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodPost, htu, bound, nil), http.StatusUnauthorized, nil},
+		{"other-url", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, "http://example.com/v2", bound, nil), http.StatusUnauthorized, nil},
+		{"normalized-url", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, "HTTP://Example.com:80/v1?query", bound, nil), http.StatusOK, nil},
+		{"expired", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, htu, bound, jwt.MapClaims{"iat": time.Now().Add(-2 * time.Minute).Unix()}), http.StatusUnauthorized, nil},
+		{"future", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, htu, bound, jwt.MapClaims{"iat": time.Now().Add(time.Minute).Unix()}), http.StatusUnauthorized, nil},
+		{"other-token", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, htu, bearer, nil), http.StatusUnauthorized, nil},
+		{"no-jti", "/v1", "DPoP " + bound, signTestProof(t, key, http.MethodGet, htu, bound, jwt.MapClaims{"jti": ""}), http.StatusUnauthorized, nil},
+		{"private-key", "/v1", "DPoP " + bound, private, http.StatusUnauthorized, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			if test.proof != "" {
+				req.Header.Set("DPoP", test.proof)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				var status restutil.Status
+				json.NewDecoder(w.Body).Decode(&status)
+				t.Fatalf("expected status to be %v, got %v: %s", test.status, w.Code, status.Message)
+			}
+			if test.challenges == nil {
+				return
+			}
+
+			challenges := w.Header()["Www-Authenticate"]
+			if len(challenges) != len(test.challenges) {
+				t.Fatalf("expected challenges %q, got %q", test.challenges, challenges)
+			}
+			for i := range challenges {
+				if challenges[i] != test.challenges[i] {
+					t.Errorf("expected challenge %q, got %q", test.challenges[i], challenges[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package nelly
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/pharmatics/rest-util"
+)
+
+// ExternalAuthorizationOpts is the configuration that will be used by WithExternalAuthorization
+type ExternalAuthorizationOpts struct {
+	// URL of the policy decision endpoint, e.g. the OPA data API of a rule
+	// "http://localhost:8181/v1/data/http/authz". The input document is posted
+	// as {"input": {...}}.
+	URL string
+	// Headers are the request headers sent in the input document, the other
+	// headers are never sent to the policy service
+	Headers []string
+	// FailOpen allows the requests when the policy service can't be reached
+	// or returns an error.
+	// Default: false, the requests are rejected
+	FailOpen bool
+	// Timeout of the requests to the policy service.
+	// Default: 2 seconds
+	Timeout time.Duration
+	// CacheSize is the maximum number of decisions held by the cache.
+	// Default: 1000
+	CacheSize int
+	// CacheTTL is the time a decision is cached by the hash of its input
+	// document. The decisions are not cached if negative.
+	// Default: 10 seconds
+	CacheTTL time.Duration
+	// Client is the HTTP client used to call the policy service, its Timeout
+	// is replaced by opts.Timeout.
+	// Default: an http.Client of the default transport
+	Client *http.Client
+}
+
+type routeContextKeyType int
+
+// routeKey is used to store the route template of the request
+const routeKey routeContextKeyType = iota
+
+// RouteFrom returns the route template of the request set by WithRoute
+func RouteFrom(ctx context.Context) (string, bool) {
+	route, ok := ctx.Value(routeKey).(string)
+	return route, ok
+}
+
+// WithRoute handler records the route template the handler is registered
+// with, e.g. "/v1/items/:id", which httprouter doesn't provide. It's sent as
+// the route of the input document of WithExternalAuthorization, so it must
+// be chained before it.
+func WithRoute(route string) Handler {
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			h(w, req.WithContext(context.WithValue(req.Context(), routeKey, route)), p)
+		}
+	}
+
+	return fn
+}
+
+// policyInput is the input document of a request sent to the policy service
+type policyInput struct {
+	Method  string            `json:"method"`
+	Verb    string            `json:"verb"`
+	Path    string            `json:"path"`
+	Route   string            `json:"route,omitempty"`
+	Params  map[string]string `json:"params"`
+	Headers map[string]string `json:"headers"`
+	User    *policyUser       `json:"user"`
+}
+
+// policyUser is the identity of the request in the input document
+type policyUser struct {
+	Subject string   `json:"subject"`
+	Groups  []string `json:"groups"`
+	Scopes  []string `json:"scopes"`
+	Roles   []string `json:"roles"`
+	Issuer  string   `json:"issuer"`
+	Tenant  string   `json:"tenant"`
+}
+
+// PolicyDecision is the result of the policy service, either a boolean or an
+// object with the following fields
+type PolicyDecision struct {
+	// Allow is true if the request is allowed
+	Allow bool `json:"allow"`
+	// Reason is the message of a denied request
+	Reason string `json:"reason,omitempty"`
+	// Headers are added to the response
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// UnmarshalJSON accepts a boolean decision as well as a decision object
+func (d *PolicyDecision) UnmarshalJSON(data []byte) error {
+	var allow bool
+	if err := json.Unmarshal(data, &allow); err == nil {
+		*d = PolicyDecision{Allow: allow}
+		return nil
+	}
+
+	type decision PolicyDecision
+	return json.Unmarshal(data, (*decision)(d))
+}
+
+// externalAuthorizer asks the decisions of the requests to a policy service
+type externalAuthorizer struct {
+	opts   ExternalAuthorizationOpts
+	client *http.Client
+	cache  *lruCache
+}
+
+func newExternalAuthorizer(opts ExternalAuthorizationOpts) *externalAuthorizer {
+
+	if opts.URL == "" {
+		klog.Fatalf("External authorization requires the URL of the policy service")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 1000
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = 10 * time.Second
+	}
+	headers := make([]string, len(opts.Headers))
+	for i, header := range opts.Headers {
+		headers[i] = http.CanonicalHeaderKey(header)
+	}
+	opts.Headers = headers
+
+	client := &http.Client{}
+	if opts.Client != nil {
+		*client = *opts.Client
+	}
+	client.Timeout = opts.Timeout
+
+	return &externalAuthorizer{opts: opts, client: client, cache: newLRUCache(opts.CacheSize)}
+}
+
+// input returns the input document of the request
+func (a *externalAuthorizer) input(req *http.Request, p httprouter.Params) *policyInput {
+	input := &policyInput{
+		Method:  req.Method,
+		Verb:    requestVerb(req.Method),
+		Path:    req.URL.Path,
+		Params:  make(map[string]string, len(p)),
+		Headers: map[string]string{},
+	}
+	if route, ok := RouteFrom(req.Context()); ok {
+		input.Route = route
+	}
+	for _, param := range p {
+		input.Params[param.Key] = param.Value
+	}
+	for _, header := range a.opts.Headers {
+		if value := req.Header.Get(header); value != "" {
+			input.Headers[header] = value
+		}
+	}
+	if user, ok := UserFrom(req.Context()); ok {
+		input.User = &policyUser{
+			Subject: user.Subject,
+			Groups:  user.Groups,
+			Scopes:  user.Scopes,
+			Roles:   user.Roles,
+			Issuer:  user.Issuer,
+			Tenant:  user.Tenant,
+		}
+	}
+	return input
+}
+
+// decide returns the decision of the policy service for the input, and
+// whether it was cached
+func (a *externalAuthorizer) decide(input *policyInput) (*PolicyDecision, bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, false, err
+	}
+
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+	if value, ok := a.cache.get(key); ok {
+		return value.(*PolicyDecision), true, nil
+	}
+
+	resp, err := a.client.Post(a.opts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status code %d from policy service", resp.StatusCode)
+	}
+
+	// The result of an undefined decision is missing, the request is denied
+	result := struct {
+		Result *PolicyDecision `json:"result"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, err
+	}
+	decision := result.Result
+	if decision == nil {
+		decision = &PolicyDecision{}
+	}
+
+	if a.opts.CacheTTL > 0 {
+		a.cache.add(key, decision, time.Now().Add(a.opts.CacheTTL))
+	}
+	return decision, false, nil
+}
+
+// WithExternalAuthorization handler asks a policy service (OPA-compatible)
+// whether the request is allowed. The input document of the request holds
+// its method, path, params, allowed headers and user, and its route if it's
+// set by WithRoute. The handler adds the headers of the decision to the
+// response, and only dispatches the request to the next handler if it is
+// allowed. Otherwise, the handler will return StatusForbidden with the reason
+// of the decision. It must be chained after an authentication handler.
+func WithExternalAuthorization(opts ExternalAuthorizationOpts) Handler {
+
+	authorizer := newExternalAuthorizer(opts)
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			input := authorizer.input(req, p)
+
+			start := time.Now()
+			decision, cached, err := authorizer.decide(input)
+			if !cached {
+				externalAuthorizationLatencies.Observe(time.Since(start).Seconds())
+			}
+
+			if err != nil {
+				externalAuthorizationDecisions.WithLabelValues("error", "false").Inc()
+				klog.Errorf("Failed to authorize %v %v with %s: %v", req.Method, req.URL.Path, opts.URL, err)
+				if authorizer.opts.FailOpen {
+					h(w, req, p)
+					return
+				}
+				statusErr := restutil.Error("Failed to authorize request", restutil.StatusReasonInternalError)
+				restutil.ResponseJSON(statusErr, w, statusErr.Code)
+				return
+			}
+
+			for name, value := range decision.Headers {
+				w.Header().Set(name, value)
+			}
+
+			if decision.Allow {
+				externalAuthorizationDecisions.WithLabelValues("allow", fmt.Sprint(cached)).Inc()
+				h(w, req, p)
+				return
+			}
+
+			externalAuthorizationDecisions.WithLabelValues("deny", fmt.Sprint(cached)).Inc()
+			klog.V(4).Infof("Forbidden: %v %v, Reason: %q", req.Method, req.URL.Path, decision.Reason)
+			statusErr := restutil.Error(forbiddenMessage(authorizationAttributes(req, p), decision.Reason), restutil.StatusReasonForbidden)
+			restutil.ResponseJSON(statusErr, w, statusErr.Code)
+		}
+	}
+
+	return fn
+}
@@ -0,0 +1,218 @@
+package nelly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+// testPolicyServer is a stand-in OPA data API that allows the requests of the
+// user "admin", and of the other users to their own items
+type testPolicyServer struct {
+	*testServer
+
+	inputs []policyInput
+}
+
+func newTestPolicyServer() *testPolicyServer {
+	s := &testPolicyServer{}
+	s.testServer = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Input policyInput `json:"input"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		input := request.Input
+		s.inputs = append(s.inputs, input)
+
+		switch {
+		case input.User == nil:
+			json.NewEncoder(w).Encode(map[string]interface{}{})
+		case input.User.Subject == "admin":
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": true})
+		case input.Route == "/v1/users/:user/items/:id" && input.Params["user"] == input.User.Subject:
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+				"allow": true, "headers": map[string]string{"X-Policy": "owner"},
+			}})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+				"allow": false, "reason": "not the owner of the items",
+			}})
+		}
+	})
+	return s
+}
+
+// newTestPolicyRouter returns a router whose requests are authenticated as the
+// user of their X-Test-User header
+func newTestPolicyRouter(opts ExternalAuthorizationOpts) *httprouter.Router {
+	withUser := WithAuthentication(AuthenticatorFunc(func(req *http.Request) (*UserInfo, bool, error) {
+		if subject := req.Header.Get("X-Test-User"); subject != "" {
+			return &UserInfo{Subject: subject}, true, nil
+		}
+		return nil, false, nil
+	}))
+	withPolicy := WithExternalAuthorization(opts)
+
+	router := httprouter.New()
+	router.GET("/v1/users/:user/items/:id", withUser(WithRoute("/v1/users/:user/items/:id")(withPolicy(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))))
+	router.GET("/v1/public/items/:id", withPolicy(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+	return router
+}
+
+func TestWithExternalAuthorization(t *testing.T) {
+	server := newTestPolicyServer()
+	defer server.Close()
+
+	router := newTestPolicyRouter(ExternalAuthorizationOpts{URL: server.URL, Headers: []string{"x-tenant"}})
+
+	tests := []struct {
+		name    string
+		user    string
+		path    string
+		status  int
+		header  string
+		message string
+	}{
+		{"admin", "admin", "/v1/users/jane/items/1", http.StatusOK, "", ""},
+		{"owner", "jane", "/v1/users/jane/items/1", http.StatusOK, "owner", ""},
+		{"not-owner", "john", "/v1/users/jane/items/1", http.StatusForbidden, "",
+			`User "john" cannot get path "/v1/users/jane/items/1": not the owner of the items`},
+		{"undefined", "", "/v1/public/items/1", http.StatusForbidden, "",
+			`User "system:anonymous" cannot get path "/v1/public/items/1"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("X-Tenant", "acme")
+			req.Header.Set("Authorization", "Bearer secret")
+			if test.user != "" {
+				req.Header.Set("X-Test-User", test.user)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if header := w.Header().Get("X-Policy"); header != test.header {
+				t.Errorf("expected header %q, got %q", test.header, header)
+			}
+			if test.status == http.StatusForbidden {
+				var status restutil.Status
+				if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if status.Message != test.message || status.Reason != restutil.StatusReasonForbidden {
+					t.Errorf("expected forbidden message %q, got %s %q", test.message, status.Reason, status.Message)
+				}
+			}
+		})
+	}
+
+	input := server.inputs[0]
+	if input.Route != "/v1/users/:user/items/:id" || input.Verb != "get" || input.Params["id"] != "1" {
+		t.Errorf("unexpected input %+v", input)
+	}
+	if len(input.Headers) != 1 || input.Headers["X-Tenant"] != "acme" {
+		t.Errorf("expected only allowed headers in input, got %v", input.Headers)
+	}
+}
+
+func TestWithExternalAuthorizationCache(t *testing.T) {
+	server := newTestPolicyServer()
+	defer server.Close()
+
+	router := newTestPolicyRouter(ExternalAuthorizationOpts{URL: server.URL, CacheTTL: 50 * time.Millisecond})
+
+	serve := func(user string, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Test-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	serve("jane", "/v1/users/jane/items/1")
+	serve("jane", "/v1/users/jane/items/1")
+	if server.callCount() != 1 {
+		t.Errorf("expected decision to be cached, got %d calls", server.callCount())
+	}
+
+	serve("john", "/v1/users/jane/items/1")
+	if server.callCount() != 2 {
+		t.Errorf("expected decision of another input not to be cached, got %d calls", server.callCount())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	serve("jane", "/v1/users/jane/items/1")
+	if server.callCount() != 3 {
+		t.Errorf("expected expired decision to be asked again, got %d calls", server.callCount())
+	}
+}
+
+func TestWithExternalAuthorizationFailure(t *testing.T) {
+	server := newTestPolicyServer()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		fail     bool
+		delay    time.Duration
+		status   int
+	}{
+		{"fail-closed-error", false, true, 0, http.StatusInternalServerError},
+		{"fail-closed-timeout", false, false, 200 * time.Millisecond, http.StatusInternalServerError},
+		{"fail-open-error", true, true, 0, http.StatusOK},
+		{"fail-open-timeout", true, false, 200 * time.Millisecond, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.set(func() { server.fail, server.delay = test.fail, test.delay })
+
+			router := newTestPolicyRouter(ExternalAuthorizationOpts{URL: server.URL, FailOpen: test.failOpen, Timeout: 50 * time.Millisecond})
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/users/jane/items/1", nil)
+			req.Header.Set("X-Test-User", "john")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestExternalAuthorizationInputRoute(t *testing.T) {
+	authorizer := newExternalAuthorizer(ExternalAuthorizationOpts{URL: "http://localhost:8181/v1/data/http/authz"})
+
+	var inputs []*policyInput
+	handle := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		inputs = append(inputs, authorizer.input(r, p))
+	}
+	router := httprouter.New()
+	router.GET("/users/:name", WithRoute("/users/:name")(handle))
+	router.GET("/items/:id", handle)
+
+	// The value of the param is the static segment of the route
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/users", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/1", nil))
+
+	if inputs[0].Route != "/users/:name" || inputs[0].Params["name"] != "users" {
+		t.Errorf("unexpected input %+v", inputs[0])
+	}
+	if inputs[1].Route != "" || inputs[1].Path != "/items/1" {
+		t.Errorf("expected input without route, got %+v", inputs[1])
+	}
+}
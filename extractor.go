@@ -0,0 +1,86 @@
+package nelly
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenExtractor extracts a token from a request. It returns an empty token if
+// the request has no token, and an error only if a token is found but it is
+// malformed.
+type TokenExtractor func(req *http.Request) (string, error)
+
+// defaultExtractors extract the token from the 'Authorization: Bearer {token}' header
+var defaultExtractors = []TokenExtractor{FromHeader("Authorization", "Bearer")}
+
+// FromHeader returns a TokenExtractor that extracts the token from the header
+// with the given scheme, e.g. 'Authorization: Bearer {token}'. Headers with
+// another scheme have no token. If scheme is empty, the header value is the token.
+func FromHeader(header string, scheme string) TokenExtractor {
+	return func(req *http.Request) (string, error) {
+		value := req.Header.Get(header)
+		if value == "" || scheme == "" {
+			return value, nil
+		}
+
+		headerParts := strings.Fields(value)
+		if len(headerParts) == 0 || !strings.EqualFold(headerParts[0], scheme) {
+			return "", nil
+		}
+		if len(headerParts) != 2 {
+			return "", &AuthError{
+				Code:        ErrorCodeInvalidRequest,
+				Description: fmt.Sprintf("%s header format must be %s {token}", header, scheme),
+			}
+		}
+
+		return headerParts[1], nil
+	}
+}
+
+// FromCookie returns a TokenExtractor that extracts the token from the cookie
+// with the given name
+func FromCookie(name string) TokenExtractor {
+	return func(req *http.Request) (string, error) {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+}
+
+// FromQuery returns a TokenExtractor that extracts the token from the query
+// parameter with the given name. The parameter is stripped from the request
+// URL, so the token isn't recorded by the logging and metrics handlers.
+func FromQuery(param string) TokenExtractor {
+	return func(req *http.Request) (string, error) {
+		query := req.URL.Query()
+		token := query.Get(param)
+		if _, ok := query[param]; !ok {
+			return "", nil
+		}
+
+		query.Del(param)
+		// The URL is shared with the requests of the previous handlers
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+
+		return token, nil
+	}
+}
+
+// extractToken returns the first token found by the extractors
+func extractToken(extractors []TokenExtractor, req *http.Request) (string, error) {
+	for _, extractor := range extractors {
+		token, err := extractor(req)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,141 @@
+package nelly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestTokenExtractors(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor TokenExtractor
+		setup     func(req *http.Request)
+		token     string
+		err       bool
+	}{
+		{"header", FromHeader("Authorization", "Bearer"), func(req *http.Request) {
+			req.Header.Set("Authorization", "bearer token")
+		}, "token", false},
+		{"header-other-scheme", FromHeader("Authorization", "Bearer"), func(req *http.Request) {
+			req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		}, "", false},
+		{"header-malformed", FromHeader("Authorization", "Bearer"), func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer token token")
+		}, "", true},
+		{"header-custom-scheme", FromHeader("X-Auth", "Token"), func(req *http.Request) {
+			req.Header.Set("X-Auth", "Token token")
+		}, "token", false},
+		{"header-no-scheme", FromHeader("X-Access-Token", ""), func(req *http.Request) {
+			req.Header.Set("X-Access-Token", "token")
+		}, "token", false},
+		{"header-missing", FromHeader("Authorization", "Bearer"), func(req *http.Request) {}, "", false},
+		{"header-whitespace", FromHeader("Authorization", "Bearer"), func(req *http.Request) {
+			req.Header.Set("Authorization", " \u00a0")
+		}, "", false},
+		{"cookie", FromCookie("access_token"), func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: "token"})
+		}, "token", false},
+		{"cookie-missing", FromCookie("access_token"), func(req *http.Request) {}, "", false},
+		{"query", FromQuery("access_token"), func(req *http.Request) {}, "token", false},
+		{"query-missing", FromQuery("token"), func(req *http.Request) {}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/v1?access_token=token", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.setup(req)
+
+			token, err := test.extractor(req)
+			if token != test.token {
+				t.Errorf("expected token %q, got %q", test.token, token)
+			}
+			if (err != nil) != test.err {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestFromQueryStripsToken(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/events?access_token=token&since=10", nil)
+	// the previous handlers share the URL of the request
+	previous := req.WithContext(req.Context())
+
+	token, err := FromQuery("access_token")(req)
+	if err != nil || token != "token" {
+		t.Fatalf("expected token, got %q %v", token, err)
+	}
+
+	if req.RequestURI != "/v1/events?since=10" {
+		t.Errorf("expected token to be stripped from RequestURI, got %q", req.RequestURI)
+	}
+	if previous.URL.RequestURI() != "/v1/events?since=10" {
+		t.Errorf("expected token to be stripped from URL, got %q", previous.URL.RequestURI())
+	}
+}
+
+func TestWithAuthExtractors(t *testing.T) {
+	withAuth := WithAuth(AuthOpts{
+		Keys:       HMACSecret("secret"),
+		Algorithms: []string{"HS256"},
+		Extractors: []TokenExtractor{
+			FromHeader("Authorization", "Bearer"),
+			FromCookie("access_token"),
+			FromQuery("access_token"),
+		},
+	})
+
+	var rawQuery string
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		rawQuery = r.URL.RawQuery
+	}))
+
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "user"})
+
+	tests := []struct {
+		name     string
+		url      string
+		setup    func(req *http.Request)
+		status   int
+		rawQuery string
+	}{
+		{"header", "/v1", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}, http.StatusOK, ""},
+		{"cookie", "/v1", func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+		}, http.StatusOK, ""},
+		{"query", "/v1?stream=true&access_token=" + token, func(req *http.Request) {}, http.StatusOK, "stream=true"},
+		{"invalid-cookie", "/v1", func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: "invalid"})
+		}, http.StatusUnauthorized, ""},
+		{"none", "/v1", func(req *http.Request) {}, http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rawQuery = ""
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			test.setup(req)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if rawQuery != test.rawQuery {
+				t.Errorf("expected query %q, got %q", test.rawQuery, rawQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package nelly
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileReloader reads a file again when it's modified, for the stores that
+// are backed by a file. The modification time of the file is checked at most
+// once per checkPeriod. On failure, the store keeps the content it previously
+// parsed.
+type fileReloader struct {
+	path        string
+	checkPeriod time.Duration
+	// parse replaces the content of the store by the content of the file, it
+	// must keep the previous content if it fails
+	parse func(data []byte) error
+
+	// reloadLock serializes the reloads of the file
+	reloadLock sync.Mutex
+
+	lock      sync.RWMutex
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newFileReloader returns a fileReloader of the file at path that is checked
+// every 10 seconds if checkPeriod is zero. It fails if the file can't be read
+// and parsed.
+func newFileReloader(path string, checkPeriod time.Duration, parse func(data []byte) error) (*fileReloader, error) {
+	if checkPeriod <= 0 {
+		checkPeriod = 10 * time.Second
+	}
+
+	r := &fileReloader{path: path, checkPeriod: checkPeriod, parse: parse}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload parses the file if it was modified since it was last parsed
+func (r *fileReloader) reload() error {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	r.lock.Lock()
+	r.lastCheck = time.Now()
+	modTime := r.modTime
+	r.lock.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if err := r.parse(data); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.modTime = info.ModTime()
+
+	return nil
+}
+
+// reloadIfDue reloads the file if it wasn't checked for checkPeriod
+func (r *fileReloader) reloadIfDue() error {
+	r.lock.RLock()
+	lastCheck := r.lastCheck
+	r.lock.RUnlock()
+
+	if time.Since(lastCheck) < r.checkPeriod {
+		return nil
+	}
+	return r.reload()
+}
@@ -3,11 +3,11 @@ module github.com/pharmatics/nelly
 go 1.14
 
 require (
-	github.com/auth0/go-jwt-middleware v0.0.0-20200507191422-d30d7b9ece63
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/pharmatics/rest-util v1.1.3
 	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	k8s.io/apimachinery v0.18.5
 	k8s.io/klog v1.0.0
 )
@@ -0,0 +1,246 @@
+package nelly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// HMACKey is a shared secret of an HMACKeyRing
+type HMACKey struct {
+	// ID is the 'kid' header of the tokens signed with the key
+	ID string `json:"kid"`
+	// Secret is the shared secret
+	Secret string `json:"secret"`
+	// NotBefore is the time from which the key is used, zero if always
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	// NotAfter is the time after which the key isn't used, zero if never
+	NotAfter time.Time `json:"notAfter,omitempty"`
+}
+
+// active returns true if the key is used at t
+func (k HMACKey) active(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+// hmacKeyRingFile is the JSON document of the keys of an HMACKeyRing, e.g.
+//
+//	{
+//	  "keys": [
+//	    {"kid": "2020-05", "secret": "...", "notAfter": "2020-06-08T00:00:00Z"},
+//	    {"kid": "2020-06", "secret": "...", "notBefore": "2020-06-01T00:00:00Z"}
+//	  ]
+//	}
+type hmacKeyRingFile struct {
+	Keys []HMACKey `json:"keys"`
+}
+
+// parseHMACKeys parses and checks the keys of an hmacKeyRingFile
+func parseHMACKeys(data []byte) ([]HMACKey, error) {
+	file := hmacKeyRingFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(file.Keys))
+	for _, key := range file.Keys {
+		if key.Secret == "" {
+			return nil, fmt.Errorf("key %q has no secret", key.ID)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate key %q", key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	return file.Keys, nil
+}
+
+// HMACKeyRing is a KeySource of several shared secrets for tokens signed with
+// HMAC signing methods (HS256, HS384 and HS512). The secrets are keyed by kid
+// and used between their NotBefore and NotAfter times, so the secret can be
+// rotated without a flag day between the issuer and the consumers.
+type HMACKeyRing struct {
+	// file or env is the source of the keys, if any
+	file *fileReloader
+	env  string
+
+	// reloadLock serializes the reloads of the environment variable
+	reloadLock sync.Mutex
+
+	lock    sync.RWMutex
+	keys    []HMACKey
+	version uint64
+	// value is the last read value of the environment variable
+	value string
+}
+
+// NewHMACKeyRing creates a new HMACKeyRing of the given keys
+func NewHMACKeyRing(keys ...HMACKey) *HMACKeyRing {
+	r := &HMACKeyRing{}
+	r.SetKeys(keys...)
+	return r
+}
+
+// NewFileHMACKeyRing creates a new HMACKeyRing of the keys of the JSON file
+// at path, which is reloaded when it's modified. Its modification time is
+// checked at most once per checkPeriod (10 seconds if zero). It fails if the
+// keys can't be read.
+func NewFileHMACKeyRing(path string, checkPeriod time.Duration) (*HMACKeyRing, error) {
+	r := &HMACKeyRing{}
+
+	file, err := newFileReloader(path, checkPeriod, r.parse)
+	if err != nil {
+		return nil, err
+	}
+	r.file = file
+
+	return r, nil
+}
+
+// NewEnvHMACKeyRing creates a new HMACKeyRing of the keys of the JSON document
+// in the environment variable name. The variable is read again by Reload.
+// It fails if the keys can't be read.
+func NewEnvHMACKeyRing(name string) (*HMACKeyRing, error) {
+	r := &HMACKeyRing{env: name}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetKeys replaces the keys of the key ring
+func (r *HMACKeyRing) SetKeys(keys ...HMACKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.keys = keys
+	r.version++
+}
+
+// Reload reads the keys from the file or environment variable of the key ring
+// if they changed. On failure, the previous keys are kept.
+func (r *HMACKeyRing) Reload() error {
+	if r.file != nil {
+		return r.file.reload()
+	}
+	if r.env == "" {
+		return nil
+	}
+
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	value, ok := os.LookupEnv(r.env)
+	if !ok {
+		return fmt.Errorf("environment variable %s is not set", r.env)
+	}
+
+	r.lock.RLock()
+	previous := r.value
+	r.lock.RUnlock()
+	if value == previous {
+		return nil
+	}
+
+	if err := r.parse([]byte(value)); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.value = value
+
+	return nil
+}
+
+// parse replaces the keys of the key ring by the keys of the JSON document
+func (r *HMACKeyRing) parse(data []byte) error {
+	keys, err := parseHMACKeys(data)
+	if err != nil {
+		return err
+	}
+
+	r.SetKeys(keys...)
+	return nil
+}
+
+// currentKeys returns the keys of the key ring, the file of the key ring is
+// reloaded if it's due
+func (r *HMACKeyRing) currentKeys() []HMACKey {
+	if r.file != nil {
+		if err := r.file.reloadIfDue(); err != nil {
+			klog.Errorf("Failed to reload HMAC keys from %s: %v", r.file.path, err)
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.keys
+}
+
+// KeysVersion implements RotatingKeySource
+func (r *HMACKeyRing) KeysVersion() uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.version
+}
+
+// VerificationKey implements KeySource. It returns the active key named in
+// the kid header of token. If the token has no kid or an unknown one, all
+// the active keys are tried to verify its signature.
+func (r *HMACKeyRing) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+	}
+
+	now := time.Now()
+	kid, _ := token.Header["kid"].(string)
+
+	var active []HMACKey
+	for _, key := range r.currentKeys() {
+		if kid != "" && key.ID == kid {
+			if !key.active(now) {
+				return nil, fmt.Errorf("Key %q is not active", kid)
+			}
+			return []byte(key.Secret), nil
+		}
+		if key.active(now) {
+			active = append(active, key)
+		}
+	}
+
+	// The token has no kid or an unknown one
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Token is malformed")
+	}
+	signingString := strings.Join(parts[:2], ".")
+	for _, key := range active {
+		if token.Method.Verify(signingString, parts[2], []byte(key.Secret)) == nil {
+			return []byte(key.Secret), nil
+		}
+	}
+
+	return nil, errors.New("No active key verifies the token signature")
+}
+
+// WithAuthSigningMethodHS256KeyRing handler authenticates requests with JWT token
+// using HS256 algorithm and the keys of the given HMACKeyRing
+func WithAuthSigningMethodHS256KeyRing(keys *HMACKeyRing, audience string, issuer string) Handler {
+	return WithAuth(AuthOpts{
+		Keys:       keys,
+		Audience:   audience,
+		Issuer:     issuer,
+		Algorithms: []string{jwt.SigningMethodHS256.Alg()},
+	})
+}
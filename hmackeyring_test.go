@@ -0,0 +1,178 @@
+package nelly
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func signTestHMACToken(t *testing.T, secret string, kid string) string {
+	return signTestToken(t, jwt.SigningMethodHS256, []byte(secret), kid, jwt.MapClaims{"sub": "user"})
+}
+
+func TestHMACKeyRing(t *testing.T) {
+	now := time.Now()
+	keys := NewHMACKeyRing(
+		HMACKey{ID: "old", Secret: "old-secret", NotAfter: now.Add(-time.Minute)},
+		HMACKey{ID: "current", Secret: "current-secret", NotBefore: now.Add(-time.Hour)},
+		HMACKey{ID: "next", Secret: "next-secret", NotBefore: now.Add(time.Hour)},
+	)
+
+	authenticator := NewJWTAuthenticator(AuthOpts{Keys: keys, Algorithms: []string{"HS256"}})
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"kid", signTestHMACToken(t, "current-secret", "current"), true},
+		{"no-kid", signTestHMACToken(t, "current-secret", ""), true},
+		{"unknown-kid", signTestHMACToken(t, "current-secret", "unknown"), true},
+		{"wrong-secret-of-kid", signTestHMACToken(t, "next-secret", "current"), false},
+		{"expired-key", signTestHMACToken(t, "old-secret", "old"), false},
+		{"expired-key-no-kid", signTestHMACToken(t, "old-secret", ""), false},
+		{"not-active-yet", signTestHMACToken(t, "next-secret", "next"), false},
+		{"unknown-secret", signTestHMACToken(t, "other", ""), false},
+		{"other-algorithm", signTestToken(t, jwt.SigningMethodHS512, []byte("current-secret"), "current", jwt.MapClaims{}), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+
+			_, ok, err := authenticator.AuthenticateRequest(req)
+			if ok != test.valid {
+				t.Errorf("expected valid to be %v, got %v (%v)", test.valid, ok, err)
+			}
+		})
+	}
+}
+
+func writeHMACKeys(t *testing.T, path string, modTime time.Time, keys ...HMACKey) {
+	data, err := json.Marshal(hmacKeyRingFile{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path+".tmp", modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	// the file is replaced atomically, as done by the secret managers
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileHMACKeyRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	now := time.Now()
+	writeHMACKeys(t, path, now.Add(-time.Hour), HMACKey{ID: "key-1", Secret: "secret-1"})
+
+	keys, err := NewFileHMACKeyRing(path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	authenticator := NewJWTAuthenticator(AuthOpts{Keys: keys})
+
+	authenticate := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, ok, _ := authenticator.AuthenticateRequest(req)
+		return ok
+	}
+
+	token1 := signTestHMACToken(t, "secret-1", "key-1")
+	token2 := signTestHMACToken(t, "secret-2", "key-2")
+
+	// the tokens are authenticated while the keys are rotated
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				if !authenticate(token1) {
+					t.Errorf("expected token of key-1 to be valid during the rotation")
+					return
+				}
+			}
+		}()
+	}
+
+	writeHMACKeys(t, path, now, HMACKey{ID: "key-1", Secret: "secret-1"}, HMACKey{ID: "key-2", Secret: "secret-2"})
+	time.Sleep(20 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	if !authenticate(token2) {
+		t.Errorf("expected token of the new key to be valid")
+	}
+
+	// the keys are kept if the file is invalid
+	writeHMACKeys(t, path, now.Add(time.Hour), HMACKey{ID: "key-2"})
+	time.Sleep(5 * time.Millisecond)
+	if !authenticate(token1) || !authenticate(token2) {
+		t.Errorf("expected previous keys to be kept")
+	}
+
+	if _, err := NewFileHMACKeyRing(filepath.Join(dir, "missing.json"), 0); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+}
+
+func TestEnvHMACKeyRing(t *testing.T) {
+	const name = "NELLY_TEST_HMAC_KEYS"
+	defer os.Unsetenv(name)
+
+	if _, err := NewEnvHMACKeyRing(name); err == nil {
+		t.Errorf("expected error for unset variable")
+	}
+
+	os.Setenv(name, `{"keys": [{"kid": "key-1", "secret": "secret-1"}]}`)
+	keys, err := NewEnvHMACKeyRing(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	version := keys.KeysVersion()
+
+	os.Setenv(name, `{"keys": [{"kid": "key-2", "secret": "secret-2"}]}`)
+	if err := keys.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys.KeysVersion() == version {
+		t.Errorf("expected version to change with the reloaded keys")
+	}
+
+	token, _ := jwt.Parse(signTestHMACToken(t, "secret-2", "key-2"), nil)
+	if _, err := keys.VerificationKey(token); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	os.Setenv(name, `{"keys": [{"kid": "key-2", "secret": "secret-2"}, {"kid": "key-2", "secret": "secret-3"}]}`)
+	if err := keys.Reload(); err == nil {
+		t.Errorf("expected error for duplicate keys")
+	}
+}
@@ -0,0 +1,156 @@
+package nelly
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/pharmatics/rest-util"
+)
+
+// Impersonation headers (Kubernetes-style)
+const (
+	ImpersonateUserHeader        = "Impersonate-User"
+	ImpersonateGroupHeader       = "Impersonate-Group"
+	ImpersonateExtraHeaderPrefix = "Impersonate-Extra-"
+)
+
+type impersonatorContextKeyType int
+
+// impersonatorKey is used to store the original caller of an impersonated request
+const impersonatorKey impersonatorContextKeyType = iota
+
+// ImpersonatorFrom returns the authenticated user that impersonated the user
+// of the request, e.g. for audit
+func ImpersonatorFrom(ctx context.Context) (*UserInfo, bool) {
+	user, ok := ctx.Value(impersonatorKey).(*UserInfo)
+	return user, ok
+}
+
+// impersonationRequest is an impersonated resource and value
+type impersonationRequest struct {
+	resource string
+	name     string
+}
+
+// impersonationRequests returns the impersonated user, groups and extras of
+// the headers, and the user that impersonates them
+func impersonationRequests(header http.Header) ([]impersonationRequest, *UserInfo, error) {
+	var requests []impersonationRequest
+	user := &UserInfo{Extra: map[string]interface{}{}}
+
+	user.Subject = header.Get(ImpersonateUserHeader)
+	if user.Subject != "" {
+		requests = append(requests, impersonationRequest{resource: "users", name: user.Subject})
+	}
+
+	for _, group := range header[ImpersonateGroupHeader] {
+		requests = append(requests, impersonationRequest{resource: "groups", name: group})
+		user.Groups = append(user.Groups, group)
+	}
+
+	for name, values := range header {
+		if !strings.HasPrefix(name, ImpersonateExtraHeaderPrefix) {
+			continue
+		}
+		key, err := url.PathUnescape(strings.ToLower(name[len(ImpersonateExtraHeaderPrefix):]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid impersonation header %s", name)
+		}
+		for _, value := range values {
+			requests = append(requests, impersonationRequest{resource: "userextras/" + key, name: value})
+		}
+		user.Extra[key] = values
+	}
+
+	if user.Subject == "" && len(requests) != 0 {
+		return nil, nil, fmt.Errorf("Impersonating groups or extras requires the %s header", ImpersonateUserHeader)
+	}
+
+	return requests, user, nil
+}
+
+// WithImpersonation handler lets the authenticated user act as another user
+// with the Impersonate-User, Impersonate-Group and Impersonate-Extra-<key>
+// headers. The authorizer is asked whether the user may "impersonate" each
+// of the values, with the Resource and Name attributes of the value. If all
+// of them are allowed, the impersonated user replaces the authenticated user
+// in the request context, which is kept as the impersonator, see
+// ImpersonatorFrom. Otherwise, the handler will return StatusForbidden. It
+// must be chained after an authentication handler.
+func WithImpersonation(authorizer Authorizer) Handler {
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			requests, impersonated, err := impersonationRequests(req.Header)
+			if err != nil {
+				statusErr := restutil.Error(err.Error(), restutil.StatusReasonBadRequest)
+				restutil.ResponseJSON(statusErr, w, statusErr.Code)
+				return
+			}
+			if len(requests) == 0 {
+				h(w, req, p)
+				return
+			}
+
+			attributes := authorizationAttributes(req, p)
+			attributes.Verb = "impersonate"
+
+			for _, request := range requests {
+				attributes.Resource, attributes.Name = request.resource, request.name
+
+				authorized, reason, err := authorizer.Authorize(req.Context(), attributes)
+				if authorized == DecisionAllow {
+					continue
+				}
+				if err != nil {
+					klog.Errorf("Failed to authorize impersonation of %s %q: %v", request.resource, request.name, err)
+				}
+
+				klog.V(4).Infof("Forbidden impersonation: %v %v, %s %q, Reason: %q", req.Method, req.URL.Path, request.resource, request.name, reason)
+				statusErr := restutil.Error(impersonationForbiddenMessage(attributes, reason), restutil.StatusReasonForbidden)
+				restutil.ResponseJSON(statusErr, w, statusErr.Code)
+				return
+			}
+
+			// The impersonation headers are not passed to the next handlers
+			for name := range req.Header {
+				if name == ImpersonateUserHeader || name == ImpersonateGroupHeader || strings.HasPrefix(name, ImpersonateExtraHeaderPrefix) {
+					req.Header.Del(name)
+				}
+			}
+
+			ctx := req.Context()
+			if attributes.User != nil {
+				ctx = context.WithValue(ctx, impersonatorKey, attributes.User)
+			}
+			req = req.WithContext(WithUser(ctx, impersonated))
+
+			h(w, req, p)
+		}
+	}
+
+	return fn
+}
+
+func impersonationForbiddenMessage(a Attributes, reason string) string {
+	username := AnonymousUser
+	if a.User != nil {
+		username = a.User.Subject
+	}
+
+	message := fmt.Sprintf("User %q cannot impersonate %s %q", username, a.Resource, a.Name)
+	if len(reason) != 0 {
+		message += ": " + reason
+	}
+
+	return message
+}
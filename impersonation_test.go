@@ -0,0 +1,110 @@
+package nelly
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestWithImpersonation(t *testing.T) {
+	// support may impersonate any user of the group customers
+	authorizer := AuthorizerFunc(func(ctx context.Context, a Attributes) (Decision, string, error) {
+		if a.Verb != "impersonate" || a.User == nil || a.User.Subject != "support" {
+			return DecisionNoOpinion, "", nil
+		}
+		switch {
+		case a.Resource == "users", a.Resource == "groups" && a.Name == "customers", a.Resource == "userextras/scopes":
+			return DecisionAllow, "", nil
+		}
+		return DecisionDeny, "only customers may be impersonated", nil
+	})
+
+	var user, impersonator *UserInfo
+	var headers http.Header
+	router := httprouter.New()
+	router.GET("/v1", withTestUser(&UserInfo{Subject: "support"})(WithImpersonation(authorizer)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user, _ = UserFrom(r.Context())
+		impersonator, _ = ImpersonatorFrom(r.Context())
+		headers = r.Header
+	})))
+	router.GET("/v1/anonymous", WithImpersonation(authorizer)(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string][]string
+		status  int
+		user    *UserInfo
+		message string
+	}{
+		{"no-impersonation", "/v1", nil, http.StatusOK, &UserInfo{Subject: "support"}, ""},
+		{"user", "/v1", map[string][]string{"Impersonate-User": {"jane"}}, http.StatusOK,
+			&UserInfo{Subject: "jane", Extra: map[string]interface{}{}}, ""},
+		{"user-groups-extras", "/v1", map[string][]string{
+			"Impersonate-User":         {"jane"},
+			"Impersonate-Group":        {"customers"},
+			"Impersonate-Extra-Scopes": {"read", "write"},
+		}, http.StatusOK,
+			&UserInfo{Subject: "jane", Groups: []string{"customers"}, Extra: map[string]interface{}{"scopes": []string{"read", "write"}}}, ""},
+		{"forbidden-group", "/v1", map[string][]string{"Impersonate-User": {"jane"}, "Impersonate-Group": {"admins"}}, http.StatusForbidden, nil,
+			`User "support" cannot impersonate groups "admins": only customers may be impersonated`},
+		{"group-without-user", "/v1", map[string][]string{"Impersonate-Group": {"customers"}}, http.StatusBadRequest, nil,
+			"Impersonating groups or extras requires the Impersonate-User header"},
+		{"anonymous", "/v1/anonymous", map[string][]string{"Impersonate-User": {"jane"}}, http.StatusForbidden, nil,
+			`User "system:anonymous" cannot impersonate users "jane"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, impersonator, headers = nil, nil, nil
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			for name, values := range test.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+
+			if test.status != http.StatusOK {
+				var status restutil.Status
+				if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if status.Message != test.message {
+					t.Errorf("expected message %q, got %q", test.message, status.Message)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(user, test.user) {
+				t.Errorf("expected user %+v, got %+v", test.user, user)
+			}
+			if len(test.headers) == 0 {
+				if impersonator != nil {
+					t.Errorf("expected no impersonator, got %+v", impersonator)
+				}
+				return
+			}
+			if impersonator == nil || impersonator.Subject != "support" {
+				t.Errorf("expected impersonator support, got %+v", impersonator)
+			}
+			for name := range headers {
+				if _, ok := test.headers[name]; ok {
+					t.Errorf("expected header %s to be removed", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package nelly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// IntrospectionOpts is the configuration that will be used by NewIntrospectionAuthenticator
+type IntrospectionOpts struct {
+	// URL of the token introspection endpoint (RFC 7662)
+	URL string
+	// ClientID and ClientSecret are the client credentials used to
+	// authenticate to the introspection endpoint with HTTP Basic auth
+	ClientID     string
+	ClientSecret string
+	// TokenTypeHint is sent as the 'token_type_hint' parameter.
+	// Default: "access_token"
+	TokenTypeHint string
+	// Audience is the expected 'aud' of the introspected token, it's not
+	// checked if empty
+	Audience string
+	// Issuer is the expected 'iss' of the introspected token, it's not
+	// checked if empty
+	Issuer string
+	// ClaimsMapper maps the introspection response to the UserInfo stored in
+	// the request context, the same way as the claims of a JWT token.
+	// Default: DefaultClaimsMapper
+	ClaimsMapper ClaimsMapper
+	// Extractors extract the token from the request, they are tried in order
+	// until a token is found.
+	// Default: FromHeader("Authorization", "Bearer")
+	Extractors []TokenExtractor
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated.
+	// Default: DefaultErrorRenderer
+	ErrorRenderer ErrorRenderer
+	// CacheSize is the maximum number of introspection results held by the cache.
+	// Default: 1000
+	CacheSize int
+	// CacheTTL is the maximum time an active token is cached, active tokens
+	// are never cached past their 'exp'.
+	// Default: 5 minutes
+	CacheTTL time.Duration
+	// NegativeCacheTTL is the time an inactive or rejected token is cached.
+	// Default: 10 seconds
+	NegativeCacheTTL time.Duration
+	// Client is the HTTP client used to call the introspection endpoint.
+	// Default: an http.Client with a 10 seconds timeout
+	Client *http.Client
+}
+
+// introspectionResult is a cached introspection result, either a user or an error
+type introspectionResult struct {
+	user *UserInfo
+	err  error
+}
+
+// introspectionAuthenticator authenticates requests with an opaque token
+// validated by a token introspection endpoint
+type introspectionAuthenticator struct {
+	opts  IntrospectionOpts
+	cache *lruCache
+}
+
+// NewIntrospectionAuthenticator returns an Authenticator that validates opaque
+// tokens with the token introspection endpoint (RFC 7662) of opts.URL. The
+// result of the introspection is cached by token.
+func NewIntrospectionAuthenticator(opts IntrospectionOpts) Authenticator {
+
+	if opts.URL == "" {
+		klog.Fatalf("Token introspection requires the URL of the introspection endpoint")
+	}
+	if opts.TokenTypeHint == "" {
+		opts.TokenTypeHint = "access_token"
+	}
+	if opts.ClaimsMapper == nil {
+		opts.ClaimsMapper = DefaultClaimsMapper
+	}
+	if len(opts.Extractors) == 0 {
+		opts.Extractors = defaultExtractors
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 1000
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = 5 * time.Minute
+	}
+	if opts.NegativeCacheTTL <= 0 {
+		opts.NegativeCacheTTL = 10 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &introspectionAuthenticator{opts: opts, cache: newLRUCache(opts.CacheSize)}
+}
+
+// AuthenticateRequest implements Authenticator
+func (a *introspectionAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	token, err := extractToken(a.opts.Extractors, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if token == "" {
+		return nil, false, nil
+	}
+
+	key := tokenCacheKey(token)
+	if value, ok := a.cache.get(key); ok {
+		result := value.(introspectionResult)
+		if result.err != nil {
+			return nil, false, result.err
+		}
+		return copyUserInfo(result.user), true, nil
+	}
+
+	claims, err := a.introspect(token)
+	if err != nil {
+		// Failures of the endpoint are not cached
+		klog.Errorf("Failed to introspect token with %s: %v", a.opts.URL, err)
+		return nil, false, errors.New("Failed to introspect token")
+	}
+
+	user, err := a.validate(claims)
+	if err != nil {
+		a.cache.add(key, introspectionResult{err: err}, time.Now().Add(a.opts.NegativeCacheTTL))
+		return nil, false, err
+	}
+
+	expiresAt := time.Now().Add(a.opts.CacheTTL)
+	if !user.Expiry.IsZero() && user.Expiry.Before(expiresAt) {
+		expiresAt = user.Expiry
+	}
+	a.cache.add(key, introspectionResult{user: copyUserInfo(user)}, expiresAt)
+
+	return user, true, nil
+}
+
+// introspect posts the token to the introspection endpoint and returns its response
+func (a *introspectionAuthenticator) introspect(token string) (jwt.MapClaims, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", a.opts.TokenTypeHint)
+
+	req, err := http.NewRequest(http.MethodPost, a.opts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.opts.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.opts.ClientID), url.QueryEscape(a.opts.ClientSecret))
+	}
+
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from introspection endpoint", resp.StatusCode)
+	}
+
+	claims := jwt.MapClaims{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// validate checks the introspection response and maps it to the user
+func (a *introspectionAuthenticator) validate(claims jwt.MapClaims) (*UserInfo, error) {
+	if active, _ := claims["active"].(bool); !active {
+		return nil, newTokenError("The token isn't active")
+	}
+	delete(claims, "active")
+
+	// Check 'exp', 'iat' and 'nbf' of the active token
+	if err := (ValidationOpts{}).validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	if !verifyAudience(claims, a.opts.Audience, false) {
+		return nil, ErrInvalidAudience
+	}
+	if !verifyIssuer(claims, a.opts.Issuer, false) {
+		return nil, ErrInvalidIssuer
+	}
+
+	return a.opts.ClaimsMapper(claims)
+}
+
+// WithIntrospection handler authenticates requests with opaque token validated
+// by a token introspection endpoint, see NewIntrospectionAuthenticator
+func WithIntrospection(opts IntrospectionOpts) Handler {
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: opts.ErrorRenderer}, NewIntrospectionAuthenticator(opts))
+}
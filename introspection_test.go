@@ -0,0 +1,151 @@
+package nelly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// testIntrospectionServer is a stand-in introspection endpoint that answers
+// with the response registered for each token
+type testIntrospectionServer struct {
+	*testServer
+
+	responses map[string]map[string]interface{}
+}
+
+func newTestIntrospectionServer(clientID, clientSecret string) *testIntrospectionServer {
+	s := &testIntrospectionServer{responses: map[string]map[string]interface{}{}}
+	s.testServer = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != clientID || secret != clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		response, ok := s.responses[r.PostFormValue("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	return s
+}
+
+func TestWithIntrospection(t *testing.T) {
+	server := newTestIntrospectionServer("client", "secret")
+	defer server.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	server.responses["valid"] = map[string]interface{}{"active": true, "sub": "user", "scope": "read write", "aud": "api", "exp": exp}
+	server.responses["wrong-audience"] = map[string]interface{}{"active": true, "sub": "user", "aud": "other", "exp": exp}
+	server.responses["expired"] = map[string]interface{}{"active": true, "sub": "user", "aud": "api", "exp": time.Now().Add(-time.Minute).Unix()}
+
+	withAuth := WithIntrospection(IntrospectionOpts{
+		URL:          server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Audience:     "api",
+	})
+
+	var user *UserInfo
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		current, _ := UserFrom(r.Context())
+		user = copyUserInfo(current)
+		// the cached identity can't be changed by the handlers
+		current.Scopes[0] = "changed"
+	}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		calls  int
+	}{
+		{"valid", "valid", http.StatusOK, 1},
+		{"valid-cached", "valid", http.StatusOK, 1},
+		{"inactive", "unknown", http.StatusUnauthorized, 2},
+		{"inactive-cached", "unknown", http.StatusUnauthorized, 2},
+		{"wrong-audience", "wrong-audience", http.StatusUnauthorized, 3},
+		{"expired", "expired", http.StatusUnauthorized, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user = nil
+			if status := doTestRequest(t, ts.URL+"/v1", test.token); status != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, status)
+			}
+			if server.callCount() != test.calls {
+				t.Errorf("expected %d introspection calls, got %d", test.calls, server.callCount())
+			}
+			if test.status == http.StatusOK {
+				if user == nil || user.Subject != "user" || !reflect.DeepEqual(user.Scopes, []string{"read", "write"}) || user.Expiry.Unix() != exp {
+					t.Errorf("unexpected user %+v", user)
+				}
+			}
+		})
+	}
+}
+
+func TestIntrospectionCacheTTL(t *testing.T) {
+	server := newTestIntrospectionServer("client", "secret")
+	defer server.Close()
+	server.responses["valid"] = map[string]interface{}{"active": true, "sub": "user"}
+
+	authenticator := NewIntrospectionAuthenticator(IntrospectionOpts{
+		URL:              server.URL,
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		CacheTTL:         20 * time.Millisecond,
+		NegativeCacheTTL: 20 * time.Millisecond,
+	})
+
+	authenticate := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, ok, _ := authenticator.AuthenticateRequest(req)
+		return ok
+	}
+
+	if !authenticate("valid") || authenticate("pending") {
+		t.Fatalf("unexpected introspection results")
+	}
+
+	// the results are introspected again once they expired
+	server.set(func() {
+		server.responses["valid"] = map[string]interface{}{"active": false}
+		server.responses["pending"] = map[string]interface{}{"active": true}
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	if authenticate("valid") || !authenticate("pending") {
+		t.Errorf("expected expired results to be introspected again")
+	}
+	if server.callCount() != 4 {
+		t.Errorf("expected 4 introspection calls, got %d", server.callCount())
+	}
+
+	// failures of the endpoint are not cached
+	server.set(func() { server.fail = true })
+	for i := 0; i < 2; i++ {
+		if authenticate("unknown") {
+			t.Errorf("expected failed introspection not to authenticate")
+		}
+	}
+	if server.callCount() != 6 {
+		t.Errorf("expected 6 introspection calls, got %d", server.callCount())
+	}
+}
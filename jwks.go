@@ -0,0 +1,409 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var errUnknownKid = errors.New("Invlid token: can't find appropriate kid header claim")
+
+// Jwks is a set of keys which contains the public keys used to verify JWT issued
+// by the authorization server.
+type Jwks struct {
+	Keys []JSONWebKeys `json:"keys"`
+}
+
+// JSONWebKeys is a JSON Web Key
+type JSONWebKeys struct {
+	Kty string   `json:"kty"`
+	Kid string   `json:"kid"`
+	Use string   `json:"use"`
+	Alg string   `json:"alg,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	X5c []string `json:"x5c,omitempty"`
+
+	// publicKey is the parsed public key, set when the key is fetched by JWKSCache
+	publicKey interface{}
+}
+
+// PublicKey returns the public key of the JSON Web Key, which is an *rsa.PublicKey
+// for RSA keys, an *ecdsa.PublicKey for EC keys (P-256, P-384 and P-521) and an
+// ed25519.PublicKey for OKP keys (Ed25519). RSA keys are parsed from the modulus
+// and exponent, or from the first x5c certificate if they are not set.
+func (k JSONWebKeys) PublicKey() (interface{}, error) {
+	if k.publicKey != nil {
+		return k.publicKey, nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		if k.N == "" || k.E == "" {
+			return k.x5cPublicKey()
+		}
+		n, err := jwt.DecodeSegment(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %v", err)
+		}
+		e, err := jwt.DecodeSegment(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %v", err)
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		var exponent int
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %q", k.Crv)
+		}
+		x, err := jwt.DecodeSegment(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %v", err)
+		}
+		y, err := jwt.DecodeSegment(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key: the point is not on the curve")
+		}
+		return key, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve %q", k.Crv)
+		}
+		x, err := jwt.DecodeSegment(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Ed25519 key: %v", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (k JSONWebKeys) x5cPublicKey() (interface{}, error) {
+	if len(k.X5c) == 0 {
+		return nil, errors.New("the key has neither modulus and exponent nor x5c certificate")
+	}
+
+	der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid x5c certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x5c certificate: %v", err)
+	}
+
+	return cert.PublicKey, nil
+}
+
+// verifies checks that the key can be used to verify signatures of the given algorithm
+func (k JSONWebKeys) verifies(alg string) error {
+	if k.Use != "" && k.Use != "sig" {
+		return fmt.Errorf("Invalid token: key %q is not a signing key", k.Kid)
+	}
+	if k.Alg != "" && k.Alg != alg {
+		return fmt.Errorf("Invalid token: key %q can't be used with %s signing method", k.Kid, alg)
+	}
+
+	key, err := k.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	if !keyMatchesAlgorithm(key, alg) {
+		return fmt.Errorf("Invalid token: key %q can't be used with %s signing method", k.Kid, alg)
+	}
+
+	return nil
+}
+
+// keyMatchesAlgorithm checks that the public key type is the one of the signing algorithm
+func keyMatchesAlgorithm(key interface{}, alg string) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case "ES256":
+			return k.Curve == elliptic.P256()
+		case "ES384":
+			return k.Curve == elliptic.P384()
+		case "ES512":
+			return k.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return alg == SigningMethodEdDSA.Alg()
+	}
+
+	return false
+}
+
+// JWKSOpts is the configuration that will be used by NewJWKSCache
+type JWKSOpts struct {
+	// URL of the JWKS endpoint of the authorization server
+	URL string
+	// TTL is how long a fetched key set is considered fresh. The background
+	// refresh started by Run fetches the key set every TTL/2.
+	// Default: 1 hour
+	TTL time.Duration
+	// MinRefreshInterval is the minimum time between two fetches that are
+	// forced by a request (a token with an unknown kid or an expired key set),
+	// so junk tokens can't trigger fetch storms against the authorization server.
+	// Default: 1 minute
+	MinRefreshInterval time.Duration
+	// ServeStale keeps serving the last fetched key set after it expired
+	// if the authorization server can't be reached.
+	// Default: false
+	ServeStale bool
+	// Client is the HTTP client used to fetch the key set.
+	// Default: an http.Client with a 10 seconds timeout
+	Client *http.Client
+}
+
+// JWKSCache caches the key set of a JWKS endpoint, so that the keys are not
+// fetched on every authenticated request.
+type JWKSCache struct {
+	opts JWKSOpts
+	// now returns the current time, it's replaced by the tests
+	now func() time.Time
+
+	// fetchLock serializes fetches of the key set
+	fetchLock sync.Mutex
+
+	lock      sync.RWMutex
+	keys      map[string]JSONWebKeys
+	expiresAt time.Time
+	lastFetch time.Time
+	lastErr   error
+	// version is incremented whenever the fetched keys change
+	version uint64
+}
+
+// NewJWKSCache creates a new JWKSCache. The key set is fetched lazily on the
+// first lookup, call Run to keep it refreshed in the background.
+func NewJWKSCache(opts JWKSOpts) *JWKSCache {
+	return &JWKSCache{opts: jwksOptsWithDefaults(opts), now: time.Now}
+}
+
+func jwksOptsWithDefaults(opts JWKSOpts) JWKSOpts {
+	if opts.TTL <= 0 {
+		opts.TTL = time.Hour
+	}
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = time.Minute
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return opts
+}
+
+// Run refreshes the key set every TTL/2 until stopCh is closed.
+func (c *JWKSCache) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(c.opts.TTL / 2)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Refresh(); err != nil {
+			klog.Errorf("Failed to refresh JWKS from %s: %v", c.opts.URL, err)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the key set from the JWKS endpoint. On failure, the
+// previously fetched keys are kept.
+func (c *JWKSCache) Refresh() error {
+	c.lock.RLock()
+	requested := c.lastFetch
+	c.lock.RUnlock()
+
+	return c.refresh(requested)
+}
+
+// refresh fetches the key set unless another fetch has completed since
+// requested, in which case the result of that fetch is used.
+func (c *JWKSCache) refresh(requested time.Time) error {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	c.lock.RLock()
+	lastFetch, lastErr := c.lastFetch, c.lastErr
+	c.lock.RUnlock()
+	if lastFetch.After(requested) {
+		return lastErr
+	}
+
+	keys, err := c.fetch()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastFetch = c.now()
+	c.lastErr = err
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(c.keys, keys) {
+		c.version++
+	}
+	c.keys = keys
+	c.expiresAt = c.lastFetch.Add(c.opts.TTL)
+
+	return nil
+}
+
+func (c *JWKSCache) fetch() (map[string]JSONWebKeys, error) {
+	resp, err := c.opts.Client.Get(c.opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from JWKS endpoint", resp.StatusCode)
+	}
+
+	var jwks = Jwks{}
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]JSONWebKeys, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.publicKey, err = key.PublicKey(); err != nil {
+			klog.Warningf("Ignoring key %q of JWKS %s: %v", key.Kid, c.opts.URL, err)
+			continue
+		}
+		keys[key.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// Key returns the JSON Web Key with the given kid. The key set is refetched
+// if it expired or if it doesn't contain kid, at most once per MinRefreshInterval.
+func (c *JWKSCache) Key(kid string) (JSONWebKeys, error) {
+	c.lock.RLock()
+	keys, expiresAt, lastFetch, lastErr := c.keys, c.expiresAt, c.lastFetch, c.lastErr
+	c.lock.RUnlock()
+
+	now := c.now()
+	canRefresh := now.Sub(lastFetch) >= c.opts.MinRefreshInterval
+
+	if keys == nil || now.After(expiresAt) {
+		if canRefresh {
+			lastErr = c.refresh(lastFetch)
+			canRefresh = false
+
+			c.lock.RLock()
+			keys, expiresAt = c.keys, c.expiresAt
+			c.lock.RUnlock()
+		}
+		if keys == nil || (now.After(expiresAt) && !c.opts.ServeStale) {
+			if lastErr == nil {
+				lastErr = errors.New("JWKS has expired")
+			}
+			return JSONWebKeys{}, fmt.Errorf("Failed to fetch JWKS: %v", lastErr)
+		}
+	}
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	if !canRefresh {
+		return JSONWebKeys{}, errUnknownKid
+	}
+
+	// The key set may have been rotated since the last fetch
+	if err := c.refresh(lastFetch); err != nil {
+		klog.Errorf("Failed to refresh JWKS from %s: %v", c.opts.URL, err)
+		return JSONWebKeys{}, errUnknownKid
+	}
+
+	c.lock.RLock()
+	key, ok := c.keys[kid]
+	c.lock.RUnlock()
+	if !ok {
+		return JSONWebKeys{}, errUnknownKid
+	}
+
+	return key, nil
+}
+
+// KeysVersion implements RotatingKeySource, the version changes whenever
+// the fetched key set differs from the previous one
+func (c *JWKSCache) KeysVersion() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.version
+}
+
+// VerificationKey returns the public key of the JSON Web Key that is named
+// in the kid header of token. It implements KeySource.
+func (c *JWKSCache) VerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := c.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := key.verifies(token.Method.Alg()); err != nil {
+		return nil, err
+	}
+
+	return key.PublicKey()
+}
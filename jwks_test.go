@@ -0,0 +1,434 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+type testJWKSServer struct {
+	*testServer
+
+	keys []JSONWebKeys
+}
+
+func newTestJWKSServer(keys ...JSONWebKeys) *testJWKSServer {
+	s := &testJWKSServer{keys: keys}
+	s.testServer = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Jwks{Keys: s.keys})
+	})
+	return s
+}
+
+func (s *testJWKSServer) setKeys(keys ...JSONWebKeys) {
+	s.set(func() { s.keys = keys })
+}
+
+// testClock is a clock that is moved forward by the tests
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestRSAKey generates an RSA key and its JSON Web Key with a self-signed x5c certificate
+func newTestRSAKey(t *testing.T, kid string) (*rsa.PrivateKey, JSONWebKeys) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: kid},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, JSONWebKeys{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		X5c: []string{base64.StdEncoding.EncodeToString(der)},
+	}
+}
+
+// testJWK returns the JSON Web Key of an RSA, EC or Ed25519 public key
+func testJWK(kid string, key interface{}) JSONWebKeys {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKeys{
+			Kty: "RSA",
+			Kid: kid,
+			N:   jwt.EncodeSegment(k.N.Bytes()),
+			E:   jwt.EncodeSegment(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		return JSONWebKeys{
+			Kty: "EC",
+			Kid: kid,
+			Crv: k.Curve.Params().Name,
+			X:   jwt.EncodeSegment(append(x[:size-len(k.X.Bytes())], k.X.Bytes()...)),
+			Y:   jwt.EncodeSegment(append(y[:size-len(k.Y.Bytes())], k.Y.Bytes()...)),
+		}
+	case ed25519.PublicKey:
+		return JSONWebKeys{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: jwt.EncodeSegment(k)}
+	}
+	panic("unsupported key type")
+}
+
+// signTestToken signs a token with the given claims and kid header
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// doTestRequest sends a GET request to url with the bearer token and returns the response status code
+func doTestRequest(t *testing.T, url string, token string) int {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestJSONWebKeysPublicKey(t *testing.T) {
+	rsaKey, x5cJWK := newTestRSAKey(t, "rsa-x5c")
+	ec256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name     string
+		jwk      JSONWebKeys
+		expected interface{}
+	}{
+		{"rsa-x5c", x5cJWK, &rsaKey.PublicKey},
+		{"rsa-modulus", testJWK("rsa", &rsaKey.PublicKey), &rsaKey.PublicKey},
+		{"ec-p256", testJWK("ec256", &ec256.PublicKey), &ec256.PublicKey},
+		{"ec-p384", testJWK("ec384", &ec384.PublicKey), &ec384.PublicKey},
+		{"ed25519", testJWK("ed", edPublic), edPublic},
+		{"rsa-no-key", JSONWebKeys{Kty: "RSA", Kid: "empty"}, nil},
+		{"ec-unknown-curve", JSONWebKeys{Kty: "EC", Kid: "ec", Crv: "P-192"}, nil},
+		{"ec-not-on-curve", JSONWebKeys{Kty: "EC", Kid: "ec", Crv: "P-256", X: "AQ", Y: "AQ"}, nil},
+		{"oct", JSONWebKeys{Kty: "oct", Kid: "oct"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := test.jwk.PublicKey()
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected error, got key %v", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(key, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, key)
+			}
+		})
+	}
+}
+
+func TestWithAuthAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	encJWK := testJWK("enc", &rsaKey.PublicKey)
+	encJWK.Use = "enc"
+	ps256JWK := testJWK("ps256", &rsaKey.PublicKey)
+	ps256JWK.Alg = "PS256"
+
+	server := newTestJWKSServer(
+		testJWK("rsa", &rsaKey.PublicKey),
+		testJWK("ec", &ecKey.PublicKey),
+		testJWK("ed", edPublic),
+		encJWK,
+		ps256JWK,
+	)
+	defer server.Close()
+
+	withAuth := WithAuth(AuthOpts{
+		Keys:       NewJWKSCache(JWKSOpts{URL: server.URL}),
+		Audience:   "audience",
+		Issuer:     "issuer",
+		Algorithms: []string{"RS256", "ES256", "EdDSA"},
+	})
+
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	claims := jwt.MapClaims{"aud": "audience", "iss": "issuer", "exp": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"rs256", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims), http.StatusOK},
+		{"es256", signTestToken(t, jwt.SigningMethodES256, ecKey, "ec", claims), http.StatusOK},
+		{"eddsa", signTestToken(t, SigningMethodEdDSA, edPrivate, "ed", claims), http.StatusOK},
+		{"not-allowed-algorithm", signTestToken(t, jwt.SigningMethodRS384, rsaKey, "rsa", claims), http.StatusUnauthorized},
+		{"key-type-mismatch", signTestToken(t, jwt.SigningMethodES256, ecKey, "rsa", claims), http.StatusUnauthorized},
+		{"hmac-with-public-key", signTestToken(t, jwt.SigningMethodHS256, []byte(server.URL), "rsa", claims), http.StatusUnauthorized},
+		{"encryption-key", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "enc", claims), http.StatusUnauthorized},
+		{"key-algorithm-mismatch", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "ps256", claims), http.StatusUnauthorized},
+		{"wrong-audience", signTestToken(t, jwt.SigningMethodES256, ecKey, "ec", jwt.MapClaims{"aud": "other"}), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := doTestRequest(t, ts.URL+"/v1", test.token); status != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, status)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheCachesKeys(t *testing.T) {
+	_, jwk := newTestRSAKey(t, "key-1")
+	server := newTestJWKSServer(jwk)
+	defer server.Close()
+
+	cache := NewJWKSCache(JWKSOpts{URL: server.URL})
+
+	for i := 0; i < 3; i++ {
+		key, err := cache.Key("key-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if key.Kid != "key-1" {
+			t.Errorf("expected kid %q, got %q", "key-1", key.Kid)
+		}
+	}
+
+	if server.callCount() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.callCount())
+	}
+}
+
+func TestJWKSCacheUnknownKid(t *testing.T) {
+	_, jwk1 := newTestRSAKey(t, "key-1")
+	_, jwk2 := newTestRSAKey(t, "key-2")
+	server := newTestJWKSServer(jwk1)
+	defer server.Close()
+
+	clock := newTestClock()
+	cache := NewJWKSCache(JWKSOpts{URL: server.URL, MinRefreshInterval: time.Minute})
+	cache.now = clock.Now
+
+	if _, err := cache.Key("key-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// rotated key set is not refetched before MinRefreshInterval
+	server.setKeys(jwk1, jwk2)
+	for i := 0; i < 5; i++ {
+		if _, err := cache.Key("key-2"); err != errUnknownKid {
+			t.Errorf("expected %v, got %v", errUnknownKid, err)
+		}
+	}
+	if server.callCount() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.callCount())
+	}
+
+	clock.add(time.Minute)
+
+	if _, err := cache.Key("key-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.callCount() != 2 {
+		t.Errorf("expected 2 fetches, got %d", server.callCount())
+	}
+}
+
+func TestJWKSCacheServeStale(t *testing.T) {
+	_, jwk := newTestRSAKey(t, "key-1")
+
+	for _, serveStale := range []bool{true, false} {
+		server := newTestJWKSServer(jwk)
+
+		clock := newTestClock()
+		cache := NewJWKSCache(JWKSOpts{
+			URL:                server.URL,
+			TTL:                time.Hour,
+			MinRefreshInterval: time.Minute,
+			ServeStale:         serveStale,
+		})
+		cache.now = clock.Now
+
+		if _, err := cache.Key("key-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		server.set(func() { server.fail = true })
+		clock.add(time.Hour + time.Second)
+
+		_, err := cache.Key("key-1")
+		if serveStale && err != nil {
+			t.Errorf("expected stale key to be served, got %v", err)
+		}
+		if !serveStale && err == nil {
+			t.Errorf("expected error for expired key set")
+		}
+		if server.callCount() != 2 {
+			t.Errorf("expected 2 fetches, got %d", server.callCount())
+		}
+
+		server.Close()
+	}
+}
+
+func TestJWKSCacheRun(t *testing.T) {
+	_, jwk := newTestRSAKey(t, "key-1")
+	server := newTestJWKSServer(jwk)
+	defer server.Close()
+
+	cache := NewJWKSCache(JWKSOpts{URL: server.URL})
+
+	// Run fetches the key set before it waits for stopCh
+	stopCh := make(chan struct{})
+	close(stopCh)
+	cache.Run(stopCh)
+
+	if server.callCount() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.callCount())
+	}
+	if _, err := cache.Key("key-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if server.callCount() != 1 {
+		t.Errorf("expected the fetched key set to be used, got %d fetches", server.callCount())
+	}
+}
+
+func TestWithAuthSigningMethodRS256JWKS(t *testing.T) {
+	key, jwk := newTestRSAKey(t, "key-1")
+	server := newTestJWKSServer(jwk)
+	defer server.Close()
+
+	withAuth := WithAuthSigningMethodRS256JWKS(NewJWKSCache(JWKSOpts{URL: server.URL}), "audience", "issuer")
+
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	signed := signTestToken(t, jwt.SigningMethodRS256, key, "key-1", jwt.MapClaims{
+		"aud": "audience",
+		"iss": "issuer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{signed, http.StatusOK},
+		{signed, http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{signed + "x", http.StatusUnauthorized},
+	} {
+		if status := doTestRequest(t, ts.URL+"/v1", test.token); status != test.status {
+			t.Errorf("expected status to be %v, got %v", test.status, status)
+		}
+	}
+
+	if server.callCount() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.callCount())
+	}
+}
+
+func TestWithAuthSigningMethodRS256(t *testing.T) {
+	key, jwk := newTestRSAKey(t, "key-1")
+	server := newTestJWKSServer(jwk)
+	defer server.Close()
+
+	router := httprouter.New()
+	router.GET("/v1", WithAuthSigningMethodRS256(server.URL, "audience", "issuer")(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// The key set is fetched by the first request
+	if server.callCount() != 0 {
+		t.Errorf("expected no fetch before the first request, got %d", server.callCount())
+	}
+
+	signed := signTestToken(t, jwt.SigningMethodRS256, key, "key-1", jwt.MapClaims{
+		"aud": "audience",
+		"iss": "issuer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	for i := 0; i < 2; i++ {
+		if status := doTestRequest(t, ts.URL+"/v1", signed); status != http.StatusOK {
+			t.Errorf("expected status to be %v, got %v", http.StatusOK, status)
+		}
+	}
+
+	if server.callCount() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.callCount())
+	}
+}
@@ -74,6 +74,48 @@ var (
 		},
 		[]string{"verb", "resource", "code"},
 	)
+
+	tokenCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "nelly_token_cache_hits_total",
+			Help: "Number of authenticated requests whose token was found in the validated token cache.",
+		},
+	)
+
+	tokenCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "nelly_token_cache_misses_total",
+			Help: "Number of authenticated requests whose token was not found in the validated token cache.",
+		},
+	)
+
+	revokedTokens = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "nelly_revoked_tokens_total",
+			Help: "Number of requests rejected because their token has been revoked.",
+		},
+	)
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nelly_auth_failures_total",
+			Help: "Number of requests rejected by the authentication handlers broken out by error code, 'no_credentials' if the request has no credentials.",
+		},
+		[]string{"code"},
+	)
+	externalAuthorizationDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nelly_external_authorization_decisions_total",
+			Help: "Number of decisions of the external authorization policy service broken out by decision (allow, deny or error) and whether the decision was cached.",
+		},
+		[]string{"decision", "cached"},
+	)
+	externalAuthorizationLatencies = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "nelly_external_authorization_duration_seconds",
+			Help:    "Latency distribution in seconds of the requests to the external authorization policy service.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
 )
 
 // RegisterMetrics registers metrics of all Nelly supported middlewares
@@ -85,6 +127,12 @@ func RegisterMetrics() {
 	prometheus.MustRegister(droppedRequests)
 	prometheus.MustRegister(currentInflightRequests)
 	prometheus.MustRegister(requestTerminationsTotal)
+	prometheus.MustRegister(tokenCacheHits)
+	prometheus.MustRegister(tokenCacheMisses)
+	prometheus.MustRegister(revokedTokens)
+	prometheus.MustRegister(authFailures)
+	prometheus.MustRegister(externalAuthorizationDecisions)
+	prometheus.MustRegister(externalAuthorizationLatencies)
 }
 
 // WithInstrument handler wraps httprouter.Handle to record prometheus metrics
@@ -0,0 +1,159 @@
+package nelly
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TenantOpts is the validation configuration of the tokens of a tenant issuer.
+// The Issuer of AuthOpts is set to the issuer the configuration is keyed by,
+// and its Extractors and ErrorRenderer are ignored in favor of the ones of
+// MultiIssuerOpts. Its DPoP configuration applies to the tokens of the issuer,
+// the tokens sent with the DPoP scheme are rejected if it isn't enabled.
+type TenantOpts struct {
+	// Tenant is the name of the tenant that is recorded in UserInfo.Tenant
+	Tenant string
+
+	AuthOpts
+}
+
+// MultiIssuerOpts is the configuration that will be used by NewMultiIssuerAuthenticator
+type MultiIssuerOpts struct {
+	// Issuers maps the 'iss' claim to the validation configuration of its tokens
+	Issuers map[string]TenantOpts
+	// Extractors extract the token from the request, they are tried in order
+	// until a token is found.
+	// Default: FromHeader("Authorization", "Bearer")
+	Extractors []TokenExtractor
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated.
+	// Default: DefaultErrorRenderer, or NewDPoPErrorRenderer if DPoP is
+	// enabled by any issuer
+	ErrorRenderer ErrorRenderer
+}
+
+type tenantAuthenticator struct {
+	tenant        string
+	authenticator *jwtAuthenticator
+}
+
+// multiIssuerAuthenticator authenticates requests with a JWT token using
+// the validation configuration of the token issuer
+type multiIssuerAuthenticator struct {
+	issuers    map[string]tenantAuthenticator
+	extractors []TokenExtractor
+	// dpop is true if any issuer enables DPoP
+	dpop bool
+}
+
+// NewMultiIssuerAuthenticator returns an Authenticator that validates JWT
+// tokens with the configuration of their issuer. The issuer is picked from the
+// unverified 'iss' claim, so tokens of unknown issuers are rejected before any
+// key is fetched. The tenant of the issuer is recorded in UserInfo.Tenant.
+func NewMultiIssuerAuthenticator(opts MultiIssuerOpts) Authenticator {
+
+	issuers := make(map[string]tenantAuthenticator, len(opts.Issuers))
+	for issuer, tenantOpts := range opts.Issuers {
+		tenantOpts.Issuer = issuer
+		issuers[issuer] = tenantAuthenticator{
+			tenant:        tenantOpts.Tenant,
+			authenticator: NewJWTAuthenticator(tenantOpts.AuthOpts).(*jwtAuthenticator),
+		}
+	}
+
+	extractors := opts.Extractors
+	if len(extractors) == 0 {
+		extractors = defaultExtractors
+	}
+
+	authenticator := &multiIssuerAuthenticator{issuers: issuers, extractors: extractors}
+	for _, tenant := range issuers {
+		authenticator.dpop = authenticator.dpop || tenant.authenticator.opts.DPoP.Enabled
+	}
+
+	return authenticator
+}
+
+// AuthenticateRequest implements Authenticator
+func (a *multiIssuerAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	token, dpop, err := a.extractToken(req)
+	if err != nil {
+		return nil, false, err
+	}
+	if token == "" {
+		return nil, false, nil
+	}
+
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil, false, err
+	}
+
+	issuer, _ := claims["iss"].(string)
+	tenant, ok := a.issuers[issuer]
+	if !ok {
+		return nil, false, ErrInvalidIssuer
+	}
+
+	user, id, err := tenant.authenticator.authenticateToken(token)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tenant.authenticator.verifyDPoP(req, token, dpop, id); err != nil {
+		return nil, false, err
+	}
+	user.Tenant = tenant.tenant
+
+	return user, true, nil
+}
+
+// extractToken returns the token of the request, and whether it's sent with
+// the DPoP scheme
+func (a *multiIssuerAuthenticator) extractToken(req *http.Request) (string, bool, error) {
+	if a.dpop {
+		token, err := dpopExtractor(req)
+		if err != nil || token != "" {
+			return token, token != "", err
+		}
+	}
+
+	token, err := extractToken(a.extractors, req)
+	return token, false, err
+}
+
+// dpopOpts returns the DPoP configuration of the challenges of the issuers:
+// the algorithms allowed by any issuer, and bearer tokens are rejected only
+// if all the issuers require DPoP
+func (a *multiIssuerAuthenticator) dpopOpts() DPoPOpts {
+	opts := DPoPOpts{Enabled: true, Required: true}
+	seen := map[string]bool{}
+	for _, tenant := range a.issuers {
+		dpop := tenant.authenticator.opts.DPoP
+		opts.Required = opts.Required && dpop.Enabled && dpop.Required
+		if !dpop.Enabled {
+			continue
+		}
+		for _, alg := range dpop.Algorithms {
+			if !seen[alg] {
+				seen[alg] = true
+				opts.Algorithms = append(opts.Algorithms, alg)
+			}
+		}
+	}
+	sort.Strings(opts.Algorithms)
+	return opts
+}
+
+// WithMultiIssuerAuth handler authenticates requests with JWT token validated with
+// the configuration of its issuer, see NewMultiIssuerAuthenticator
+func WithMultiIssuerAuth(opts MultiIssuerOpts) Handler {
+	authenticator := NewMultiIssuerAuthenticator(opts).(*multiIssuerAuthenticator)
+
+	renderer := opts.ErrorRenderer
+	if renderer == nil && authenticator.dpop {
+		renderer = NewDPoPErrorRenderer("", authenticator.dpopOpts())
+	}
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: renderer}, authenticator)
+}
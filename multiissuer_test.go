@@ -0,0 +1,147 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestWithMultiIssuerAuth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newTestJWKSServer(testJWK("rsa", &rsaKey.PublicKey))
+	defer server.Close()
+
+	withAuth := WithMultiIssuerAuth(MultiIssuerOpts{
+		Issuers: map[string]TenantOpts{
+			"https://a.example.com": {
+				Tenant: "tenant-a",
+				AuthOpts: AuthOpts{
+					Keys:       HMACSecret("secret"),
+					Audience:   "api-a",
+					Algorithms: []string{"HS256"},
+				},
+			},
+			"https://b.example.com": {
+				Tenant: "tenant-b",
+				AuthOpts: AuthOpts{
+					Keys:         NewJWKSCache(JWKSOpts{URL: server.URL}),
+					Audience:     "api-b",
+					Algorithms:   []string{"RS256"},
+					ClaimsMapper: NewClaimsMapper(AzureADClaimNames),
+				},
+			},
+		},
+	})
+
+	var tenant string
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		tenant, _ = TenantFrom(r.Context())
+	}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		status  int
+		tenant  string
+		fetches int
+	}{
+		{"unknown-issuer", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"iss": "https://c.example.com", "aud": "api-b"}), http.StatusUnauthorized, "", 0},
+		{"no-issuer", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"aud": "api-b"}), http.StatusUnauthorized, "", 0},
+		{"tenant-a", signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://a.example.com", "aud": "api-a"}), http.StatusOK, "tenant-a", 0},
+		{"tenant-a-wrong-audience", signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://a.example.com", "aud": "api-b"}), http.StatusUnauthorized, "", 0},
+		{"tenant-b", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"iss": "https://b.example.com", "aud": "api-b"}), http.StatusOK, "tenant-b", 1},
+		{"tenant-b-wrong-algorithm", signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://b.example.com", "aud": "api-b"}), http.StatusUnauthorized, "", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenant = ""
+			if status := doTestRequest(t, ts.URL+"/v1", test.token); status != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, status)
+			}
+			if tenant != test.tenant {
+				t.Errorf("expected tenant %q, got %q", test.tenant, tenant)
+			}
+			if server.callCount() != test.fetches {
+				t.Errorf("expected %d JWKS fetches, got %d", test.fetches, server.callCount())
+			}
+		})
+	}
+}
+
+func TestWithMultiIssuerAuthDPoP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, err := jwkThumbprint(testJWK("", &key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withAuth := WithMultiIssuerAuth(MultiIssuerOpts{
+		Issuers: map[string]TenantOpts{
+			"https://a.example.com": {
+				Tenant:   "tenant-a",
+				AuthOpts: AuthOpts{Keys: HMACSecret("secret"), DPoP: DPoPOpts{Enabled: true, Required: true}},
+			},
+			"https://b.example.com": {
+				Tenant:   "tenant-b",
+				AuthOpts: AuthOpts{Keys: HMACSecret("secret")},
+			},
+		},
+	})
+
+	router := httprouter.New()
+	router.GET("/v1", withAuth(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	htu := "http://example.com/v1"
+	boundA := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://a.example.com", "cnf": map[string]interface{}{"jkt": jkt}})
+	bearerA := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://a.example.com"})
+	bearerB := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "https://b.example.com"})
+
+	tests := []struct {
+		name          string
+		authorization string
+		proof         string
+		status        int
+	}{
+		{"dpop", "DPoP " + boundA, signTestProof(t, key, http.MethodGet, htu, boundA, nil), http.StatusOK},
+		{"bound-bearer", "Bearer " + boundA, "", http.StatusUnauthorized},
+		{"no-proof", "DPoP " + boundA, "", http.StatusUnauthorized},
+		{"required", "Bearer " + bearerA, "", http.StatusUnauthorized},
+		{"bearer-other-issuer", "Bearer " + bearerB, "", http.StatusOK},
+		{"dpop-other-issuer", "DPoP " + bearerB, signTestProof(t, key, http.MethodGet, htu, bearerB, nil), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+			req.Header.Set("Authorization", test.authorization)
+			if test.proof != "" {
+				req.Header.Set("DPoP", test.proof)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "DPoP") {
+				t.Errorf("expected DPoP challenge, got %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
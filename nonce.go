@@ -0,0 +1,51 @@
+package nelly
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceStore records the nonces of the requests to reject replayed requests
+type NonceStore interface {
+	// Use records the nonce until expiresAt. It returns false if the nonce
+	// was already used.
+	Use(nonce string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryNonceStore is an in-memory NonceStore, for the services that run a
+// single instance
+type MemoryNonceStore struct {
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewMemoryNonceStore creates a new MemoryNonceStore
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+// Use implements NonceStore
+func (s *MemoryNonceStore) Use(nonce string, expiresAt time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	// The expired nonces are pruned at most once per minute
+	if now.Sub(s.lastPrune) >= time.Minute {
+		for n, expiry := range s.nonces {
+			if !now.Before(expiry) {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if expiry, ok := s.nonces[nonce]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	s.nonces[nonce] = expiresAt
+
+	return true, nil
+}
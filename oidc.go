@@ -0,0 +1,248 @@
+package nelly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// oidcDiscoveryPath is appended to the issuer URL to get the discovery document
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// oidcDiscovery is the subset of the OpenID Connect discovery document used by OIDCProvider
+type oidcDiscovery struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// OIDCOpts is the configuration that will be used by NewOIDCProvider
+type OIDCOpts struct {
+	// IssuerURL of the OpenID Connect provider. The discovery document is
+	// read from IssuerURL + "/.well-known/openid-configuration" and its
+	// issuer must match IssuerURL.
+	IssuerURL string
+	// RefreshInterval is how often the discovery document is re-read.
+	// Default: 24 hours
+	RefreshInterval time.Duration
+	// JWKS configures the key set cache of the discovered jwks_uri. Its URL
+	// is ignored, and its MinRefreshInterval also rate limits the discovery
+	// requests forced by authenticated requests.
+	JWKS JWKSOpts
+}
+
+// OIDCProvider is a KeySource that discovers the JWKS endpoint and the signing
+// algorithms of an OpenID Connect provider from its issuer URL
+type OIDCProvider struct {
+	opts OIDCOpts
+
+	// discoveryLock serializes the discovery requests
+	discoveryLock sync.Mutex
+
+	lock          sync.RWMutex
+	jwks          *JWKSCache
+	algorithms    []string
+	lastDiscovery time.Time
+	discovered    time.Time
+}
+
+// NewOIDCProvider creates a new OIDCProvider. The discovery document is read
+// lazily on the first lookup, and read again by the lookups once it's older
+// than RefreshInterval. Call Run to keep it refreshed in the background.
+func NewOIDCProvider(opts OIDCOpts) *OIDCProvider {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 24 * time.Hour
+	}
+	opts.JWKS = jwksOptsWithDefaults(opts.JWKS)
+
+	return &OIDCProvider{opts: opts}
+}
+
+// Run re-reads the discovery document every RefreshInterval and refreshes
+// the key set every JWKS.TTL/2 until stopCh is closed.
+func (p *OIDCProvider) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(p.opts.JWKS.TTL / 2)
+	defer ticker.Stop()
+
+	for {
+		p.lock.RLock()
+		discovered := p.discovered
+		p.lock.RUnlock()
+
+		if time.Since(discovered) >= p.opts.RefreshInterval {
+			if err := p.Refresh(); err != nil {
+				klog.Errorf("Failed to discover OpenID Connect provider %s: %v", p.opts.IssuerURL, err)
+			}
+		} else if jwks := p.keySet(); jwks != nil {
+			if err := jwks.Refresh(); err != nil {
+				klog.Errorf("Failed to refresh JWKS from %s: %v", jwks.opts.URL, err)
+			}
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh reads the discovery document of the provider. If the jwks_uri
+// changed, the key set is fetched from the new endpoint.
+func (p *OIDCProvider) Refresh() error {
+	p.lock.RLock()
+	requested := p.lastDiscovery
+	p.lock.RUnlock()
+
+	return p.refresh(requested)
+}
+
+// refresh reads the discovery document unless another discovery has been
+// attempted since requested
+func (p *OIDCProvider) refresh(requested time.Time) error {
+	p.discoveryLock.Lock()
+	defer p.discoveryLock.Unlock()
+
+	p.lock.RLock()
+	lastDiscovery := p.lastDiscovery
+	p.lock.RUnlock()
+	if lastDiscovery.After(requested) {
+		return nil
+	}
+
+	discovery, err := p.discover()
+
+	p.lock.Lock()
+	p.lastDiscovery = time.Now()
+	p.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	jwks := p.keySet()
+	if jwks == nil || jwks.opts.URL != discovery.JWKSURI {
+		jwksOpts := p.opts.JWKS
+		jwksOpts.URL = discovery.JWKSURI
+		previous := jwks
+		jwks = NewJWKSCache(jwksOpts)
+		if previous != nil {
+			// The versions of the new key set follow the previous one
+			jwks.version = previous.KeysVersion() + 1
+		}
+	}
+	// Fetch the keys before they are used by the requests
+	if err := jwks.Refresh(); err != nil {
+		klog.Errorf("Failed to refresh JWKS from %s: %v", discovery.JWKSURI, err)
+	}
+
+	algorithms := discovery.IDTokenSigningAlgValuesSupported
+	if len(algorithms) == 0 {
+		// RS256 is the default signing algorithm of OpenID Connect
+		algorithms = []string{jwt.SigningMethodRS256.Alg()}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.jwks = jwks
+	p.algorithms = algorithms
+	p.discovered = p.lastDiscovery
+
+	return nil
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	resp, err := p.opts.JWKS.Client.Get(strings.TrimSuffix(p.opts.IssuerURL, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from discovery endpoint", resp.StatusCode)
+	}
+
+	discovery := &oidcDiscovery{}
+	if err := json.NewDecoder(resp.Body).Decode(discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != p.opts.IssuerURL {
+		return nil, fmt.Errorf("discovered issuer %q doesn't match %q", discovery.Issuer, p.opts.IssuerURL)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	return discovery, nil
+}
+
+func (p *OIDCProvider) keySet() *JWKSCache {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.jwks
+}
+
+// KeysVersion implements RotatingKeySource
+func (p *OIDCProvider) KeysVersion() uint64 {
+	if jwks := p.keySet(); jwks != nil {
+		return jwks.KeysVersion()
+	}
+	return 0
+}
+
+// VerificationKey implements KeySource. It checks that the token signing
+// algorithm is supported by the provider, and returns the key of its kid
+// from the discovered key set.
+func (p *OIDCProvider) VerificationKey(token *jwt.Token) (interface{}, error) {
+	p.lock.RLock()
+	jwks, algorithms, lastDiscovery, discovered := p.jwks, p.algorithms, p.lastDiscovery, p.discovered
+	p.lock.RUnlock()
+
+	if jwks == nil || time.Since(discovered) >= p.opts.RefreshInterval {
+		if time.Since(lastDiscovery) >= p.opts.JWKS.MinRefreshInterval {
+			if err := p.refresh(lastDiscovery); err != nil {
+				if jwks == nil {
+					return nil, fmt.Errorf("Failed to discover OpenID Connect provider: %v", err)
+				}
+				// The previous discovery is kept
+				klog.Errorf("Failed to discover OpenID Connect provider %s: %v", p.opts.IssuerURL, err)
+			}
+
+			p.lock.RLock()
+			jwks, algorithms = p.jwks, p.algorithms
+			p.lock.RUnlock()
+		}
+		if jwks == nil {
+			return nil, errors.New("OpenID Connect provider is not discovered yet")
+		}
+	}
+
+	if !algorithmAllowed(algorithms, token.Method.Alg()) {
+		return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+	}
+
+	return jwks.VerificationKey(token)
+}
+
+// WithOIDC handler authenticates requests with JWT token issued by the OpenID
+// Connect provider of issuerURL for the given audience. The provider discovery
+// document and keys are cached, and read again by the requests once they
+// expired. Use WithAuth with an OIDCProvider refreshed by Run to refresh them
+// in the background.
+func WithOIDC(issuerURL string, audience string) Handler {
+	return WithAuth(AuthOpts{
+		Keys:     NewOIDCProvider(OIDCOpts{IssuerURL: issuerURL}),
+		Audience: audience,
+		Issuer:   issuerURL,
+	})
+}
@@ -0,0 +1,190 @@
+package nelly
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+type testOIDCServer struct {
+	*testServer
+
+	issuer      string
+	jwksPath    string
+	algorithms  []string
+	keys        map[string][]JSONWebKeys
+	discoveries int
+}
+
+func newTestOIDCServer() *testOIDCServer {
+	s := &testOIDCServer{jwksPath: "/jwks", keys: map[string][]JSONWebKeys{}}
+	s.testServer = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oidcDiscoveryPath {
+			s.discoveries++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                                s.issuer,
+				"jwks_uri":                              s.URL + s.jwksPath,
+				"id_token_signing_alg_values_supported": s.algorithms,
+			})
+			return
+		}
+
+		keys, ok := s.keys[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(Jwks{Keys: keys})
+	})
+	s.issuer = s.URL
+	return s
+}
+
+func TestWithOIDC(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	server := newTestOIDCServer()
+	defer server.Close()
+	server.keys["/jwks"] = []JSONWebKeys{testJWK("rsa", &rsaKey.PublicKey), testJWK("ec", &ecKey.PublicKey)}
+
+	router := httprouter.New()
+	router.GET("/v1", WithOIDC(server.URL, "audience")(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	claims := jwt.MapClaims{"iss": server.URL, "aud": "audience", "exp": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims), http.StatusOK},
+		{"unsupported-algorithm", signTestToken(t, jwt.SigningMethodES256, ecKey, "ec", claims), http.StatusUnauthorized},
+		{"wrong-issuer", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"iss": "https://other.example.com", "aud": "audience"}), http.StatusUnauthorized},
+		{"wrong-audience", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"iss": server.URL, "aud": "other"}), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := doTestRequest(t, ts.URL+"/v1", test.token); status != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, status)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderRediscovery(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	server := newTestOIDCServer()
+	defer server.Close()
+	server.keys["/jwks"] = []JSONWebKeys{testJWK("old", &oldKey.PublicKey)}
+	server.keys["/jwks/v2"] = []JSONWebKeys{testJWK("new", &newKey.PublicKey)}
+
+	provider := NewOIDCProvider(OIDCOpts{IssuerURL: server.URL, RefreshInterval: time.Hour})
+
+	oldToken, _ := jwt.Parse(signTestToken(t, jwt.SigningMethodRS256, oldKey, "old", jwt.MapClaims{}), nil)
+	newToken, _ := jwt.Parse(signTestToken(t, jwt.SigningMethodES256, newKey, "new", jwt.MapClaims{}), nil)
+
+	if _, err := provider.VerificationKey(oldToken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the provider moves to a new key set and signing algorithm, which is
+	// discovered by the first lookup after RefreshInterval
+	server.set(func() {
+		server.jwksPath = "/jwks/v2"
+		server.algorithms = []string{"ES256"}
+	})
+	if _, err := provider.VerificationKey(newToken); err == nil {
+		t.Errorf("expected error before RefreshInterval")
+	}
+
+	provider.lock.Lock()
+	provider.discovered = provider.discovered.Add(-time.Hour)
+	provider.lastDiscovery = provider.discovered
+	provider.lock.Unlock()
+
+	if _, err := provider.VerificationKey(newToken); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	server.set(func() {
+		if server.discoveries != 2 {
+			t.Errorf("expected the discovery document to be read twice, got %d discoveries", server.discoveries)
+		}
+	})
+}
+
+func TestOIDCProviderIssuerMismatch(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	server := newTestOIDCServer()
+	defer server.Close()
+	server.keys["/jwks"] = []JSONWebKeys{testJWK("rsa", &rsaKey.PublicKey)}
+	server.issuer = "https://attacker.example.com"
+
+	provider := NewOIDCProvider(OIDCOpts{IssuerURL: server.URL})
+	if err := provider.Refresh(); err == nil {
+		t.Errorf("expected issuer mismatch error")
+	}
+
+	token, _ := jwt.Parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{}), nil)
+	if _, err := provider.VerificationKey(token); err == nil {
+		t.Errorf("expected error for undiscovered provider")
+	}
+}
+
+func TestOIDCProviderRefresh(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	server := newTestOIDCServer()
+	defer server.Close()
+	server.keys["/jwks"] = []JSONWebKeys{testJWK("old", &oldKey.PublicKey)}
+	server.keys["/jwks/v2"] = []JSONWebKeys{testJWK("new", &newKey.PublicKey)}
+
+	provider := NewOIDCProvider(OIDCOpts{IssuerURL: server.URL, RefreshInterval: 10 * time.Millisecond, JWKS: JWKSOpts{TTL: 20 * time.Millisecond}})
+
+	oldToken, _ := jwt.Parse(signTestToken(t, jwt.SigningMethodRS256, oldKey, "old", jwt.MapClaims{}), nil)
+	newToken, _ := jwt.Parse(signTestToken(t, jwt.SigningMethodES256, newKey, "new", jwt.MapClaims{}), nil)
+
+	if _, err := provider.VerificationKey(oldToken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the provider moves to a new key set and signing algorithm
+	server.set(func() {
+		server.jwksPath = "/jwks/v2"
+		server.algorithms = []string{"ES256"}
+	})
+
+	stopCh := make(chan struct{})
+	go provider.Run(stopCh)
+	time.Sleep(50 * time.Millisecond)
+	close(stopCh)
+
+	if _, err := provider.VerificationKey(newToken); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := provider.VerificationKey(oldToken); err == nil {
+		t.Errorf("expected error for key of the previous key set")
+	}
+	server.set(func() {
+		if server.discoveries < 2 {
+			t.Errorf("expected the discovery document to be re-read, got %d discoveries", server.discoveries)
+		}
+	})
+}
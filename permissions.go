@@ -0,0 +1,88 @@
+package nelly
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// WithRequiredScopes handler checks that the authenticated user has been granted
+// all of the scopes. If any scope is missing, the handler will return StatusForbidden
+// with the missing scopes. It must be chained after an authentication handler.
+func WithRequiredScopes(scopes ...string) Handler {
+	return withPermissions(scopes, func(user *UserInfo) []string {
+		return missing(scopes, user.Scopes)
+	})
+}
+
+// WithAnyRole handler checks that the authenticated user has at least one of
+// the roles. Otherwise, the handler will return StatusForbidden with the roles.
+// It must be chained after an authentication handler.
+func WithAnyRole(roles ...string) Handler {
+	return withPermissions(nil, func(user *UserInfo) []string {
+		if len(missing(roles, user.Roles)) < len(roles) {
+			return nil
+		}
+		return roles
+	})
+}
+
+// WithAllRoles handler checks that the authenticated user has all of the roles.
+// If any role is missing, the handler will return StatusForbidden with the
+// missing roles. It must be chained after an authentication handler.
+func WithAllRoles(roles ...string) Handler {
+	return withPermissions(nil, func(user *UserInfo) []string {
+		return missing(roles, user.Roles)
+	})
+}
+
+// withPermissions returns a handler that checks the permissions of the
+// authenticated user, where check returns the missing permissions. The errors
+// are rendered by the renderer of the authentication handler as insufficient_scope,
+// with the required scopes, if any, in the challenge.
+func withPermissions(scopes []string, check func(user *UserInfo) []string) Handler {
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			renderer := errorRendererFrom(req.Context())
+
+			user, ok := UserFrom(req.Context())
+			if !ok {
+				renderer(w, req, errNoCredentials)
+				return
+			}
+
+			if missing := check(user); len(missing) != 0 {
+				renderer(w, req, &AuthError{
+					Code:        ErrorCodeInsufficientScope,
+					Description: "Missing permissions",
+					Scopes:      scopes,
+					Missing:     missing,
+				})
+				return
+			}
+
+			h(w, req, p)
+		}
+	}
+
+	return fn
+}
+
+// missing returns the required values that are not granted
+func missing(required []string, granted []string) []string {
+	grantedSet := make(map[string]bool, len(granted))
+	for _, g := range granted {
+		grantedSet[g] = true
+	}
+
+	var missing []string
+	for _, r := range required {
+		if !grantedSet[r] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,81 @@
+package nelly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+// withTestUser returns a handler that stores user in the request context
+func withTestUser(user *UserInfo) Handler {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			if user != nil {
+				r = r.WithContext(WithUser(r.Context(), user))
+			}
+			h(w, r, p)
+		}
+	}
+}
+
+func TestWithPermissions(t *testing.T) {
+	user := &UserInfo{
+		Subject: "user",
+		Scopes:  []string{"read", "write"},
+		Roles:   []string{"viewer", "editor"},
+	}
+
+	tests := []struct {
+		name    string
+		handler Handler
+		user    *UserInfo
+		status  int
+		missing []string
+	}{
+		{"scopes", WithRequiredScopes("read", "write"), user, http.StatusOK, nil},
+		{"missing-scopes", WithRequiredScopes("read", "delete", "admin"), user, http.StatusForbidden, []string{"delete", "admin"}},
+		{"any-role", WithAnyRole("admin", "editor"), user, http.StatusOK, nil},
+		{"missing-any-role", WithAnyRole("admin", "owner"), user, http.StatusForbidden, []string{"admin", "owner"}},
+		{"all-roles", WithAllRoles("viewer", "editor"), user, http.StatusOK, nil},
+		{"missing-all-roles", WithAllRoles("viewer", "admin"), user, http.StatusForbidden, []string{"admin"}},
+		{"unauthenticated", WithRequiredScopes("read"), nil, http.StatusUnauthorized, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := httprouter.New()
+			router.GET("/v1", NewChain(withTestUser(test.user), test.handler).Then(
+				func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+			req, err := http.NewRequest(http.MethodGet, "/v1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, w.Code)
+			}
+
+			if test.status == http.StatusForbidden {
+				var status restutil.Status
+				if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				var missing []string
+				for _, m := range status.Details.([]interface{}) {
+					missing = append(missing, m.(string))
+				}
+				if status.Reason != restutil.StatusReasonForbidden || !reflect.DeepEqual(missing, test.missing) {
+					t.Errorf("expected missing permissions %v, got %+v", test.missing, status)
+				}
+			}
+		})
+	}
+}
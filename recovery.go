@@ -23,7 +23,7 @@ func WithPanicRecovery() Handler {
 				return
 			}
 			http.Error(w, "This request caused nelly middleware to panic. Look in the logs for details.", http.StatusInternalServerError)
-			klog.Errorf("nelly middleware panic'd on %v %v", req.Method, req.RequestURI)
+			klog.Errorf("nelly middleware panic'd on %v %v", req.Method, req.URL.RequestURI())
 		})
 	}
 
@@ -0,0 +1,218 @@
+package nelly
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// errTokenRevoked is returned for tokens revoked by a RevocationStore
+var errTokenRevoked = newTokenError("Token has been revoked")
+
+// RevocationStore is checked for revoked tokens after their signature is validated
+type RevocationStore interface {
+	// IsRevoked returns true if the token with the given 'jti' claim, issued
+	// to subject at issuedAt, has been revoked. jti is empty and issuedAt is
+	// zero if the token has no such claims.
+	IsRevoked(jti string, subject string, issuedAt time.Time) (bool, error)
+}
+
+// tokenID holds the claims of a validated token that are checked for revocation
+// and DPoP binding
+type tokenID struct {
+	jti      string
+	issuedAt time.Time
+	// notAfter is the time after which the token is rejected, zero if never
+	notAfter time.Time
+	// jkt is the thumbprint of the DPoP key the token is bound to ('cnf.jkt'
+	// claim), empty if the token isn't bound
+	jkt string
+}
+
+func claimsTokenID(claims jwt.MapClaims) tokenID {
+	jti, _ := claims["jti"].(string)
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return tokenID{jti: jti, issuedAt: claimTime(claims["iat"]), jkt: jkt}
+}
+
+// checkRevocation returns errTokenRevoked if the token of user has been revoked
+func checkRevocation(store RevocationStore, user *UserInfo, id tokenID) error {
+	revoked, err := store.IsRevoked(id.jti, user.Subject, id.issuedAt)
+	if err != nil {
+		klog.Errorf("Failed to check revocation of token of %q: %v", user.Subject, err)
+		return errors.New("Failed to check token revocation")
+	}
+	if revoked {
+		revokedTokens.Inc()
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// revocationList is the set of revoked tokens and subjects of a RevocationStore
+type revocationList struct {
+	// tokens maps the revoked jti to the expiry of the token, after which the
+	// token doesn't need to be revoked anymore. The expiry is zero if unknown.
+	tokens map[string]time.Time
+	// subjects are revoked with all of their tokens
+	subjects map[string]bool
+	// issuedBefore maps a subject to the time before which its tokens are revoked
+	issuedBefore map[string]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		tokens:       map[string]time.Time{},
+		subjects:     map[string]bool{},
+		issuedBefore: map[string]time.Time{},
+	}
+}
+
+func (l *revocationList) isRevoked(jti string, subject string, issuedAt time.Time) bool {
+	if _, ok := l.tokens[jti]; ok && jti != "" {
+		return true
+	}
+	if l.subjects[subject] {
+		return true
+	}
+	if before, ok := l.issuedBefore[subject]; ok {
+		// Tokens without 'iat' can't be proven to be issued after the revocation
+		return issuedAt.IsZero() || issuedAt.Before(before)
+	}
+	return false
+}
+
+// MemoryRevocationStore is an in-memory RevocationStore
+type MemoryRevocationStore struct {
+	lock sync.RWMutex
+	list *revocationList
+}
+
+// NewMemoryRevocationStore creates a new empty MemoryRevocationStore
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{list: newRevocationList()}
+}
+
+// RevokeToken revokes the token with the given 'jti' claim. The revocation is
+// dropped once the token expires at expiresAt, unless expiresAt is zero.
+func (s *MemoryRevocationStore) RevokeToken(jti string, expiresAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for revoked, expiry := range s.list.tokens {
+		if !expiry.IsZero() && expiry.Before(now) {
+			delete(s.list.tokens, revoked)
+		}
+	}
+
+	s.list.tokens[jti] = expiresAt
+}
+
+// RevokeSubject revokes all the tokens of subject, including the tokens
+// issued after the revocation
+func (s *MemoryRevocationStore) RevokeSubject(subject string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list.subjects[subject] = true
+}
+
+// RevokeIssuedBefore revokes the tokens of subject that were issued before t,
+// e.g. when the user changes its password or logs out of all sessions
+func (s *MemoryRevocationStore) RevokeIssuedBefore(subject string, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list.issuedBefore[subject] = t
+}
+
+// IsRevoked implements RevocationStore
+func (s *MemoryRevocationStore) IsRevoked(jti string, subject string, issuedAt time.Time) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.list.isRevoked(jti, subject, issuedAt), nil
+}
+
+// revocationFile is the JSON document read by FileRevocationStore, e.g.
+//
+//	{
+//	  "tokens": ["d1f6a6c2-5e31-4c5e-9b5b-8e3c5f2f4a10"],
+//	  "subjects": ["user@example.com"],
+//	  "issuedBefore": {"admin@example.com": "2020-06-01T00:00:00Z"}
+//	}
+type revocationFile struct {
+	Tokens       []string             `json:"tokens"`
+	Subjects     []string             `json:"subjects"`
+	IssuedBefore map[string]time.Time `json:"issuedBefore"`
+}
+
+// FileRevocationStore is a RevocationStore that reads the revoked tokens and
+// subjects from a JSON file, which is reloaded when it's modified.
+type FileRevocationStore struct {
+	file *fileReloader
+
+	lock sync.RWMutex
+	list *revocationList
+}
+
+// NewFileRevocationStore creates a new FileRevocationStore of the file at path,
+// whose modification time is checked at most once per checkPeriod (10 seconds
+// if zero). It fails if the file can't be read.
+func NewFileRevocationStore(path string, checkPeriod time.Duration) (*FileRevocationStore, error) {
+	s := &FileRevocationStore{}
+
+	file, err := newFileReloader(path, checkPeriod, s.parse)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// Reload reads the file if it was modified since it was last read. On
+// failure, the previously read revocations are kept.
+func (s *FileRevocationStore) Reload() error {
+	return s.file.reload()
+}
+
+// parse replaces the revocations of the store by the revocations of the file
+func (s *FileRevocationStore) parse(data []byte) error {
+	file := revocationFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	list := newRevocationList()
+	for _, jti := range file.Tokens {
+		list.tokens[jti] = time.Time{}
+	}
+	for _, subject := range file.Subjects {
+		list.subjects[subject] = true
+	}
+	for subject, before := range file.IssuedBefore {
+		list.issuedBefore[subject] = before
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list = list
+
+	return nil
+}
+
+// IsRevoked implements RevocationStore
+func (s *FileRevocationStore) IsRevoked(jti string, subject string, issuedAt time.Time) (bool, error) {
+	if err := s.file.reloadIfDue(); err != nil {
+		klog.Errorf("Failed to reload revocations from %s: %v", s.file.path, err)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.list.isRevoked(jti, subject, issuedAt), nil
+}
@@ -0,0 +1,190 @@
+package nelly
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestMemoryRevocationStore(t *testing.T) {
+	now := time.Now()
+
+	store := NewMemoryRevocationStore()
+	store.RevokeToken("revoked", time.Time{})
+	store.RevokeToken("expired", now.Add(-time.Minute))
+	store.RevokeSubject("banned")
+	store.RevokeIssuedBefore("logged-out", now)
+	// the expired revocation is dropped
+	store.RevokeToken("other", now.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		jti      string
+		subject  string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"valid", "valid", "user", now, false},
+		{"no-jti", "", "user", time.Time{}, false},
+		{"revoked-jti", "revoked", "user", now, true},
+		{"expired-jti", "expired", "user", now, false},
+		{"revoked-subject", "valid", "banned", now.Add(time.Hour), true},
+		{"issued-before", "valid", "logged-out", now.Add(-time.Minute), true},
+		{"issued-after", "valid", "logged-out", now.Add(time.Minute), false},
+		{"issued-before-no-iat", "valid", "logged-out", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			revoked, err := store.IsRevoked(test.jti, test.subject, test.issuedAt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if revoked != test.revoked {
+				t.Errorf("expected revoked to be %v, got %v", test.revoked, revoked)
+			}
+		})
+	}
+}
+
+func writeRevocationFile(t *testing.T, path string, file revocationFile, modTime time.Time) {
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRevocationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "revocations.json")
+	if _, err := NewFileRevocationStore(path, 0); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+
+	now := time.Now()
+	writeRevocationFile(t, path, revocationFile{
+		Tokens:       []string{"revoked"},
+		IssuedBefore: map[string]time.Time{"logged-out": now},
+	}, now.Add(-time.Hour))
+
+	store, err := NewFileRevocationStore(path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	isRevoked := func(jti string, subject string, issuedAt time.Time) bool {
+		revoked, err := store.IsRevoked(jti, subject, issuedAt)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return revoked
+	}
+
+	if !isRevoked("revoked", "user", now) || !isRevoked("valid", "logged-out", now.Add(-time.Minute)) {
+		t.Errorf("expected tokens of the file to be revoked")
+	}
+	if isRevoked("valid", "banned", now) {
+		t.Errorf("expected token not to be revoked")
+	}
+
+	writeRevocationFile(t, path, revocationFile{Subjects: []string{"banned"}}, now)
+	time.Sleep(5 * time.Millisecond)
+
+	if !isRevoked("valid", "banned", now) {
+		t.Errorf("expected modified file to be reloaded")
+	}
+	if isRevoked("revoked", "user", now) {
+		t.Errorf("expected token removed from the file not to be revoked")
+	}
+
+	// the last revocations are kept if the file is invalid
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, now.Add(time.Hour), now.Add(time.Hour))
+	time.Sleep(5 * time.Millisecond)
+
+	if !isRevoked("valid", "banned", now) {
+		t.Errorf("expected revocations to be kept")
+	}
+}
+
+func TestWithAuthRevocations(t *testing.T) {
+	store := NewMemoryRevocationStore()
+
+	router := httprouter.New()
+	router.GET("/v1", WithAuth(AuthOpts{
+		Keys:        HMACSecret("secret"),
+		TokenCache:  TokenCacheOpts{Size: 10},
+		Revocations: store,
+	})(func(http.ResponseWriter, *http.Request, httprouter.Params) {}))
+
+	claims := func(jti, sub string) jwt.MapClaims {
+		return jwt.MapClaims{"jti": jti, "sub": sub, "iat": time.Now().Add(-time.Minute).Unix()}
+	}
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims("token", "user"))
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// the token is cached by the first request
+	if w := request(token); w.Code != http.StatusOK {
+		t.Fatalf("expected status to be %v, got %v", http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		name   string
+		revoke func()
+		token  string
+	}{
+		{"jti", func() { store.RevokeToken("token", time.Time{}) }, token},
+		{"subject", func() { store.RevokeSubject("banned") },
+			signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims("other", "banned"))},
+		{"issued-before", func() { store.RevokeIssuedBefore("logged-out", time.Now()) },
+			signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims("other", "logged-out"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.revoke()
+
+			w := request(test.token)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("expected status to be %v, got %v", http.StatusUnauthorized, w.Code)
+			}
+
+			var status restutil.Status
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Message != errTokenRevoked.Error() {
+				t.Errorf("expected message %q, got %q", errTokenRevoked.Error(), status.Message)
+			}
+		})
+	}
+}
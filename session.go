@@ -0,0 +1,537 @@
+package nelly
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var errInvalidSessionCookie = errors.New("invalid session cookie")
+
+type sessionContextKeyType int
+
+// sessionKey is used to store the session of the request
+const sessionKey sessionContextKeyType = iota
+
+// SessionFrom returns the session of the request
+func SessionFrom(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey).(*Session)
+	return session, ok
+}
+
+// Session is the session of a request. The values are encoded in JSON, so
+// they are decoded as JSON values by the next requests, e.g. the numbers are
+// float64. The session is written back to the client only if it's changed.
+type Session struct {
+	lock    sync.Mutex
+	id      string
+	values  map[string]interface{}
+	changed bool
+	cleared bool
+}
+
+// Get returns the value of key
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Set sets the value of key
+func (s *Session) Set(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[key] = value
+	s.changed = true
+}
+
+// Delete deletes the value of key
+func (s *Session) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.changed = true
+	}
+}
+
+// Clear deletes all the values of the session and its cookies, e.g. on logout.
+// The session is stored with a new ID if values are set again.
+func (s *Session) Clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values = map[string]interface{}{}
+	s.changed = true
+	s.cleared = true
+}
+
+// SessionStore stores the values of the sessions on the server side, the
+// session cookie then only holds the session ID
+type SessionStore interface {
+	// Load returns the values of the session, false if the session doesn't
+	// exist or is expired
+	Load(id string) (map[string]interface{}, bool, error)
+	// Save stores the values of the session until expiresAt
+	Save(id string, values map[string]interface{}, expiresAt time.Time) error
+	// Delete deletes the session
+	Delete(id string) error
+}
+
+// memorySession is a session of a MemorySessionStore
+type memorySession struct {
+	values    []byte
+	expiresAt time.Time
+}
+
+// MemorySessionStore is an in-memory SessionStore, for the services that run
+// a single instance. The sessions are lost when the service is restarted.
+type MemorySessionStore struct {
+	lock      sync.Mutex
+	sessions  map[string]memorySession
+	lastPrune time.Time
+}
+
+// NewMemorySessionStore creates a new MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]memorySession{}}
+}
+
+// Load implements SessionStore
+func (s *MemorySessionStore) Load(id string) (map[string]interface{}, bool, error) {
+	s.lock.Lock()
+	session, ok := s.sessions[id]
+	s.lock.Unlock()
+
+	if !ok || !time.Now().Before(session.expiresAt) {
+		return nil, false, nil
+	}
+
+	// The values are copied, so they are not shared between requests
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(session.values, &values); err != nil {
+		return nil, false, err
+	}
+	return values, true, nil
+}
+
+// Save implements SessionStore
+func (s *MemorySessionStore) Save(id string, values map[string]interface{}, expiresAt time.Time) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	// The expired sessions are pruned at most once per minute
+	if now.Sub(s.lastPrune) >= time.Minute {
+		for id, session := range s.sessions {
+			if !now.Before(session.expiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	s.sessions[id] = memorySession{values: data, expiresAt: expiresAt}
+
+	return nil
+}
+
+// Delete implements SessionStore
+func (s *MemorySessionStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// SessionOpts is the configuration that will be used by WithSession
+type SessionOpts struct {
+	// Keys are the AES keys (16, 24 or 32 bytes) the session cookie is
+	// encrypted and authenticated with (AES-GCM). The first key encrypts the
+	// cookies, the others are the previous keys during a rotation.
+	Keys [][]byte
+	// Store stores the values of the sessions on the server side, the session
+	// cookie then only holds the session ID.
+	// Default: nil (the values are stored in the cookie)
+	Store SessionStore
+	// CookieName is the name of the session cookie, the next chunks of the
+	// cookie are named '<name>.1', '<name>.2'...
+	// Default: "session"
+	CookieName string
+	// CookiePath is the path of the cookie.
+	// Default: "/"
+	CookiePath string
+	// CookieDomain is the domain of the cookie, it's a host-only cookie if empty
+	CookieDomain string
+	// CookieSecure sends the cookie over HTTPS only
+	CookieSecure bool
+	// CookieSameSite is the SameSite attribute of the cookie.
+	// Default: http.SameSiteLaxMode
+	CookieSameSite http.SameSite
+	// MaxAge is the lifetime of the session since it was last changed.
+	// Default: 24 hours
+	MaxAge time.Duration
+	// ChunkSize is the maximum size of the value of a cookie, the larger
+	// sessions are split into several cookies.
+	// Default: 4000
+	ChunkSize int
+	// MaxChunks is the maximum number of cookies of a session, the larger
+	// sessions are not saved and the error is logged.
+	// Default: 4
+	MaxChunks int
+}
+
+// sessionCookie is the encrypted content of the session cookie
+type sessionCookie struct {
+	ID        string                 `json:"id,omitempty"`
+	Values    map[string]interface{} `json:"values,omitempty"`
+	ExpiresAt int64                  `json:"exp"`
+}
+
+// sessionCodec encrypts and decrypts the session cookies
+type sessionCodec struct {
+	aeads []cipher.AEAD
+}
+
+func newSessionCodec(keys [][]byte) (*sessionCodec, error) {
+	codec := &sessionCodec{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		codec.aeads = append(codec.aeads, aead)
+	}
+	return codec, nil
+}
+
+// encrypt returns '<nonce><ciphertext>' encrypted with the first key, the
+// cookie name is authenticated so the cookie can't be used as another cookie
+func (c *sessionCodec) encrypt(name string, plaintext []byte) (string, error) {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the plaintext of the value decrypted with any of the keys
+func (c *sessionCodec) decrypt(name string, value string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidSessionCookie
+	}
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errInvalidSessionCookie
+}
+
+// sessionManager loads and saves the sessions of WithSession
+type sessionManager struct {
+	opts  SessionOpts
+	codec *sessionCodec
+}
+
+// chunkName returns the name of the cookie of the i-th chunk
+func (m *sessionManager) chunkName(i int) string {
+	if i == 0 {
+		return m.opts.CookieName
+	}
+	return m.opts.CookieName + "." + strconv.Itoa(i)
+}
+
+// readCookie returns the value of the chunked session cookie and its
+// number of chunks
+func (m *sessionManager) readCookie(req *http.Request) (string, int) {
+	var value strings.Builder
+	chunks := 0
+	for i := 0; i < m.opts.MaxChunks; i++ {
+		cookie, err := req.Cookie(m.chunkName(i))
+		if err != nil {
+			break
+		}
+		value.WriteString(cookie.Value)
+		chunks++
+	}
+	return value.String(), chunks
+}
+
+// load returns the session of the request, a new session if the request has
+// no valid session cookie
+func (m *sessionManager) load(req *http.Request) (*Session, int) {
+	session := &Session{values: map[string]interface{}{}}
+
+	value, chunks := m.readCookie(req)
+	if value == "" {
+		return session, chunks
+	}
+
+	plaintext, err := m.codec.decrypt(m.opts.CookieName, value)
+	if err != nil {
+		klog.V(4).Infof("Invalid session cookie of %v %v", req.Method, req.URL.Path)
+		return session, chunks
+	}
+	var cookie sessionCookie
+	if err := json.Unmarshal(plaintext, &cookie); err != nil || !time.Now().Before(time.Unix(cookie.ExpiresAt, 0)) {
+		return session, chunks
+	}
+
+	if m.opts.Store == nil {
+		if cookie.Values != nil {
+			session.values = cookie.Values
+		}
+		return session, chunks
+	}
+
+	values, ok, err := m.opts.Store.Load(cookie.ID)
+	if err != nil {
+		klog.Errorf("Failed to load session of %v %v: %v", req.Method, req.URL.Path, err)
+		return session, chunks
+	}
+	if ok {
+		session.id, session.values = cookie.ID, values
+	}
+
+	return session, chunks
+}
+
+// save writes the session cookies of the changed session, and stores its
+// values in the store if any
+func (m *sessionManager) save(w http.ResponseWriter, session *Session, chunks int) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if !session.changed {
+		return nil
+	}
+
+	// A cleared session gets a new ID if values are set again
+	if session.id != "" && (session.cleared || len(session.values) == 0) {
+		if err := m.opts.Store.Delete(session.id); err != nil {
+			return err
+		}
+		session.id = ""
+	}
+	if len(session.values) == 0 {
+		m.writeChunks(w, nil, chunks)
+		return nil
+	}
+
+	expiresAt := time.Now().Add(m.opts.MaxAge)
+	cookie := sessionCookie{ExpiresAt: expiresAt.Unix()}
+	if m.opts.Store == nil {
+		cookie.Values = session.values
+	} else {
+		if session.id == "" {
+			id := make([]byte, 32)
+			if _, err := rand.Read(id); err != nil {
+				return err
+			}
+			session.id = base64.RawURLEncoding.EncodeToString(id)
+		}
+		if err := m.opts.Store.Save(session.id, session.values, expiresAt); err != nil {
+			return err
+		}
+		cookie.ID = session.id
+	}
+
+	plaintext, err := json.Marshal(cookie)
+	if err != nil {
+		return err
+	}
+	value, err := m.codec.encrypt(m.opts.CookieName, plaintext)
+	if err != nil {
+		return err
+	}
+
+	var values []string
+	for len(value) > m.opts.ChunkSize {
+		values = append(values, value[:m.opts.ChunkSize])
+		value = value[m.opts.ChunkSize:]
+	}
+	values = append(values, value)
+	if len(values) > m.opts.MaxChunks {
+		return fmt.Errorf("session cookie requires %d chunks, the maximum is %d", len(values), m.opts.MaxChunks)
+	}
+
+	m.writeChunks(w, values, chunks)
+	return nil
+}
+
+// writeChunks sets the cookies of the chunks, and deletes the previous
+// chunks that are not used anymore
+func (m *sessionManager) writeChunks(w http.ResponseWriter, values []string, previous int) {
+	for i := 0; i < len(values) || i < previous; i++ {
+		cookie := &http.Cookie{
+			Name:     m.chunkName(i),
+			Path:     m.opts.CookiePath,
+			Domain:   m.opts.CookieDomain,
+			MaxAge:   -1,
+			Secure:   m.opts.CookieSecure,
+			HttpOnly: true,
+			SameSite: m.opts.CookieSameSite,
+		}
+		if i < len(values) {
+			cookie.Value = values[i]
+			cookie.MaxAge = int(m.opts.MaxAge / time.Second)
+		}
+		http.SetCookie(w, cookie)
+	}
+}
+
+// sessionResponseWriter saves the session before the response header is written
+type sessionResponseWriter struct {
+	http.ResponseWriter
+
+	req     *http.Request
+	manager *sessionManager
+	session *Session
+	chunks  int
+	saved   bool
+}
+
+func (w *sessionResponseWriter) save() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+
+	if err := w.manager.save(w.ResponseWriter, w.session, w.chunks); err != nil {
+		klog.Errorf("Failed to save session of %v %v: %v", w.req.Method, w.req.URL.Path, err)
+	}
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *sessionResponseWriter) WriteHeader(code int) {
+	w.save()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (w *sessionResponseWriter) Write(b []byte) (int, error) {
+	w.save()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (w *sessionResponseWriter) Flush() {
+	w.save()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. The session isn't saved on a hijacked
+// connection, since its cookies can't be sent with the response header anymore.
+func (w *sessionResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+
+	w.saved = true
+	return hijacker.Hijack()
+}
+
+// CloseNotify implements http.CloseNotifier, the channel is nil if the response
+// writer doesn't support it
+func (w *sessionResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// WithSession handler loads the session of the request from an encrypted and
+// authenticated cookie (AES-GCM) and stores it in the request context, see
+// SessionFrom. The values of the session are stored in the cookie, which is
+// split into several cookies if it's larger than ChunkSize, or in the Store
+// if any. The session is written back only if it was changed by the next
+// handlers, before the response header is written.
+func WithSession(opts SessionOpts) Handler {
+
+	if len(opts.Keys) == 0 {
+		klog.Fatalf("Sessions require at least one key")
+	}
+	codec, err := newSessionCodec(opts.Keys)
+	if err != nil {
+		klog.Fatalf("Invalid session key: %v", err)
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.CookiePath == "" {
+		opts.CookiePath = "/"
+	}
+	if opts.CookieSameSite == 0 {
+		opts.CookieSameSite = http.SameSiteLaxMode
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 4000
+	}
+	if opts.MaxChunks <= 0 {
+		opts.MaxChunks = 4
+	}
+
+	manager := &sessionManager{opts: opts, codec: codec}
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			session, chunks := manager.load(req)
+			sw := &sessionResponseWriter{ResponseWriter: w, req: req, manager: manager, session: session, chunks: chunks}
+
+			req = req.WithContext(context.WithValue(req.Context(), sessionKey, session))
+			h(sw, req, p)
+
+			// The handler didn't write the response
+			sw.save()
+		}
+	}
+
+	return fn
+}
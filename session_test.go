@@ -0,0 +1,205 @@
+package nelly
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// newTestSessionRouter returns a router of which the /set handler sets the
+// query values in the session, /get writes the value of the 'key' query
+// parameter, and /clear clears the session
+func newTestSessionRouter(opts SessionOpts) *httprouter.Router {
+	router := httprouter.New()
+	router.GET("/set", WithSession(opts)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		session, _ := SessionFrom(r.Context())
+		for key, values := range r.URL.Query() {
+			session.Set(key, values[0])
+		}
+	}))
+	router.GET("/get", WithSession(opts)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		session, _ := SessionFrom(r.Context())
+		value, _ := session.Get(r.URL.Query().Get("key"))
+		if value, ok := value.(string); ok {
+			w.Write([]byte(value))
+		}
+	}))
+	router.GET("/clear", WithSession(opts)(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		session, _ := SessionFrom(r.Context())
+		session.Clear()
+	}))
+	return router
+}
+
+// doSessionRequest sends a request with the cookies, and returns the response
+// body and the cookies set by the response
+func doSessionRequest(router http.Handler, target string, cookies []*http.Cookie) (string, []*http.Cookie) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Body.String(), w.Result().Cookies()
+}
+
+func TestWithSession(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	previousKey := bytes.Repeat([]byte("p"), 16)
+	large := strings.Repeat("a", 150)
+
+	tests := []struct {
+		name   string
+		opts   SessionOpts
+		value  string
+		chunks int
+	}{
+		{"cookie", SessionOpts{Keys: [][]byte{key}}, "jane", 1},
+		{"chunked", SessionOpts{Keys: [][]byte{key}, ChunkSize: 100}, large, 3},
+		{"store", SessionOpts{Keys: [][]byte{key}, Store: NewMemorySessionStore(), ChunkSize: 100}, large, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestSessionRouter(test.opts)
+
+			_, cookies := doSessionRequest(router, "/set?key="+test.value, nil)
+			if len(cookies) != test.chunks {
+				t.Fatalf("expected %d cookies, got %v", test.chunks, cookies)
+			}
+			if !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].MaxAge != int((24*time.Hour)/time.Second) {
+				t.Errorf("unexpected cookie attributes %+v", cookies[0])
+			}
+
+			body, unchanged := doSessionRequest(router, "/get?key=key", cookies)
+			if body != test.value {
+				t.Errorf("expected value %q, got %q", test.value, body)
+			}
+			if len(unchanged) != 0 {
+				t.Errorf("expected unchanged session not to be written, got %v", unchanged)
+			}
+
+			value := []byte(cookies[0].Value)
+			value[10] ^= 1
+			tampered := []*http.Cookie{{Name: "session", Value: string(value)}}
+			if body, _ := doSessionRequest(router, "/get?key=key", append(tampered, cookies[1:]...)); body != "" {
+				t.Errorf("expected tampered session to be empty, got %q", body)
+			}
+
+			_, cleared := doSessionRequest(router, "/clear", cookies)
+			if len(cleared) != test.chunks {
+				t.Fatalf("expected %d cookies to be deleted, got %v", test.chunks, cleared)
+			}
+			for _, cookie := range cleared {
+				if cookie.MaxAge >= 0 {
+					t.Errorf("expected cookie %s to be deleted", cookie.Name)
+				}
+			}
+			if test.opts.Store != nil {
+				if body, _ := doSessionRequest(router, "/get?key=key", cookies); body != "" {
+					t.Errorf("expected cleared session to be deleted from the store, got %q", body)
+				}
+			}
+		})
+	}
+
+	t.Run("key-rotation", func(t *testing.T) {
+		_, cookies := doSessionRequest(newTestSessionRouter(SessionOpts{Keys: [][]byte{previousKey}}), "/set?key=jane", nil)
+
+		router := newTestSessionRouter(SessionOpts{Keys: [][]byte{key, previousKey}})
+		if body, _ := doSessionRequest(router, "/get?key=key", cookies); body != "jane" {
+			t.Errorf("expected session of previous key, got %q", body)
+		}
+
+		router = newTestSessionRouter(SessionOpts{Keys: [][]byte{key}})
+		if body, _ := doSessionRequest(router, "/get?key=key", cookies); body != "" {
+			t.Errorf("expected session of removed key to be empty, got %q", body)
+		}
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		router := newTestSessionRouter(SessionOpts{Keys: [][]byte{key}, ChunkSize: 100, MaxChunks: 2})
+		if _, cookies := doSessionRequest(router, "/set?key="+large, nil); len(cookies) != 0 {
+			t.Errorf("expected too large session not to be written, got %v", cookies)
+		}
+	})
+
+	t.Run("fewer-chunks", func(t *testing.T) {
+		router := newTestSessionRouter(SessionOpts{Keys: [][]byte{key}, ChunkSize: 100})
+		_, cookies := doSessionRequest(router, "/set?key="+large, nil)
+		_, updated := doSessionRequest(router, "/set?key=jane", cookies)
+		if len(updated) != 3 || updated[0].MaxAge <= 0 || updated[1].MaxAge >= 0 || updated[2].MaxAge >= 0 {
+			t.Errorf("expected the unused chunks to be deleted, got %v", updated)
+		}
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+
+	if err := store.Save("id", map[string]interface{}{"user": "jane"}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values, ok, err := store.Load("id")
+	if err != nil || !ok || values["user"] != "jane" {
+		t.Errorf("expected session values, got %v, %v, %v", values, ok, err)
+	}
+
+	store.Save("expired", map[string]interface{}{"user": "jane"}, time.Now().Add(-time.Second))
+	if _, ok, _ := store.Load("expired"); ok {
+		t.Errorf("expected expired session not to be loaded")
+	}
+
+	store.Delete("id")
+	if _, ok, _ := store.Load("id"); ok {
+		t.Errorf("expected deleted session not to be loaded")
+	}
+}
+
+func TestWithSessionHijack(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/ws", WithSession(SessionOpts{Keys: [][]byte{bytes.Repeat([]byte("k"), 32)}})(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if _, ok := w.(http.CloseNotifier); !ok {
+			t.Errorf("expected http.CloseNotifier")
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n")
+		rw.Flush()
+	}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected status to be %v, got %v", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+}
+
+func TestWithSessionHijackUnsupported(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/ws", WithSession(SessionOpts{Keys: [][]byte{bytes.Repeat([]byte("k"), 32)}})(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			t.Errorf("expected error")
+		}
+		if ch := w.(http.CloseNotifier).CloseNotify(); ch != nil {
+			t.Errorf("expected nil channel")
+		}
+	}))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ws", nil))
+}
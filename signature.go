@@ -0,0 +1,211 @@
+package nelly
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/pharmatics/rest-util"
+)
+
+var (
+	errMissingSignature  = &AuthError{Description: "Request signature not found"}
+	errInvalidSignature  = newTokenError("The request signature isn't valid")
+	errExpiredSignature  = newTokenError("The request signature is expired")
+	errReplayedSignature = newTokenError("The request has already been received")
+)
+
+// HMACSignatureOpts is the configuration that will be used by WithHMACSignature
+type HMACSignatureOpts struct {
+	// Secrets are the shared secrets the requests may be signed with, e.g.
+	// the current and previous secrets during a rotation
+	Secrets []string
+	// Header is the header of the signature, e.g. "Stripe-Signature".
+	// Default: "X-Signature"
+	Header string
+	// Tolerance is the maximum difference between the signed timestamp and
+	// the time the request is received.
+	// Default: 5 minutes
+	Tolerance time.Duration
+	// NonceStore records the signatures of the requests, the requests whose
+	// signature was already received are rejected. Replays are not checked
+	// if nil.
+	NonceStore NonceStore
+	// MaxBodySize is the maximum size in bytes of the signed body.
+	// Default: 1MB
+	MaxBodySize int64
+	// ErrorRenderer writes the response of the requests whose signature
+	// isn't valid.
+	// Default: renders errors with a 'Signature' challenge, see NewBearerErrorRenderer
+	ErrorRenderer ErrorRenderer
+}
+
+// signatureHeader is a parsed signature header 't=<timestamp>,v1=<signature>'
+type signatureHeader struct {
+	timestamp  time.Time
+	signatures [][]byte
+}
+
+// parseSignatureHeader parses the timestamp and the v1 signatures of the
+// header, the other schemes are ignored
+func parseSignatureHeader(header string) (*signatureHeader, error) {
+	parsed := &signatureHeader{}
+	for _, field := range strings.Split(header, ",") {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, errInvalidSignature
+		}
+		name, value := strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:])
+
+		switch name {
+		case "t":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errInvalidSignature
+			}
+			parsed.timestamp = time.Unix(seconds, 0)
+		case "v1":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, errInvalidSignature
+			}
+			parsed.signatures = append(parsed.signatures, signature)
+		}
+	}
+
+	if parsed.timestamp.IsZero() || len(parsed.signatures) == 0 {
+		return nil, errInvalidSignature
+	}
+	return parsed, nil
+}
+
+// signPayload returns the HMAC-SHA256 of '<timestamp>.<body>'
+func signPayload(secret string, timestamp time.Time, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// SignRequestBody returns the signature header of body signed with secret at
+// timestamp, e.g. for the clients and the tests of WithHMACSignature
+func SignRequestBody(secret string, timestamp time.Time, body []byte) string {
+	return "t=" + strconv.FormatInt(timestamp.Unix(), 10) + ",v1=" + hex.EncodeToString(signPayload(secret, timestamp, body))
+}
+
+// verifySignature returns the verified signature of the body
+func verifySignature(opts HMACSignatureOpts, header string, body []byte, now time.Time) ([]byte, error) {
+	parsed, err := parseSignatureHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.timestamp.Before(now.Add(-opts.Tolerance)) || parsed.timestamp.After(now.Add(opts.Tolerance)) {
+		return nil, errExpiredSignature
+	}
+
+	for _, secret := range opts.Secrets {
+		expected := signPayload(secret, parsed.timestamp, body)
+		for _, signature := range parsed.signatures {
+			if hmac.Equal(expected, signature) {
+				return signature, nil
+			}
+		}
+	}
+	return nil, errInvalidSignature
+}
+
+// WithHMACSignature handler verifies the HMAC-SHA256 signature of the request
+// body, sent in a 't=<timestamp>,v1=<signature>' header (Stripe-style) where
+// the signature is the hex encoded HMAC of '<timestamp>.<body>'. The body is
+// restored for the next handler. If the signature isn't valid, expired or
+// replayed, the handler will return StatusUnauthorized with a 'Signature'
+// challenge.
+func WithHMACSignature(opts HMACSignatureOpts) Handler {
+
+	if len(opts.Secrets) == 0 {
+		klog.Fatalf("Request signature verification requires at least one secret")
+	}
+	if opts.Header == "" {
+		opts.Header = "X-Signature"
+	}
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = 5 * time.Minute
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 1 << 20
+	}
+	if opts.ErrorRenderer == nil {
+		opts.ErrorRenderer = newChallengeErrorRenderer("Signature", "")
+	}
+
+	fn := func(h httprouter.Handle) httprouter.Handle {
+
+		return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+
+			header := req.Header.Get(opts.Header)
+			if header == "" {
+				opts.ErrorRenderer(w, req, errMissingSignature)
+				return
+			}
+
+			var body []byte
+			if req.Body != nil {
+				var err error
+				body, err = ioutil.ReadAll(io.LimitReader(req.Body, opts.MaxBodySize+1))
+				req.Body.Close()
+				if err != nil {
+					klog.Errorf("Failed to read body of %v %v: %v", req.Method, req.URL.Path, err)
+					statusErr := restutil.Error("Failed to read request body", restutil.StatusReasonBadRequest)
+					restutil.ResponseJSON(statusErr, w, statusErr.Code)
+					return
+				}
+				if int64(len(body)) > opts.MaxBodySize {
+					statusErr := restutil.Error("Request body is too large", restutil.StatusReasonRequestEntityTooLarge)
+					restutil.ResponseJSON(statusErr, w, statusErr.Code)
+					return
+				}
+			}
+
+			now := time.Now()
+			signature, err := verifySignature(opts, header, body, now)
+			if err != nil {
+				opts.ErrorRenderer(w, req, toAuthError(err))
+				return
+			}
+
+			if opts.NonceStore != nil {
+				// The signed timestamp is at most now + Tolerance, so the
+				// signature expires before now + 2 * Tolerance
+				ok, err := opts.NonceStore.Use(hex.EncodeToString(signature), now.Add(2*opts.Tolerance))
+				if err != nil {
+					klog.Errorf("Failed to check replay of %v %v: %v", req.Method, req.URL.Path, err)
+					statusErr := restutil.Error("Failed to verify request signature", restutil.StatusReasonInternalError)
+					restutil.ResponseJSON(statusErr, w, statusErr.Code)
+					return
+				}
+				if !ok {
+					opts.ErrorRenderer(w, req, errReplayedSignature)
+					return
+				}
+			}
+
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			h(w, req, p)
+		}
+	}
+
+	return fn
+}
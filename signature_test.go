@@ -0,0 +1,116 @@
+package nelly
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pharmatics/rest-util"
+)
+
+func TestWithHMACSignature(t *testing.T) {
+	withSignature := WithHMACSignature(HMACSignatureOpts{
+		Secrets:     []string{"current", "previous"},
+		Header:      "Stripe-Signature",
+		NonceStore:  NewMemoryNonceStore(),
+		MaxBodySize: 64,
+	})
+
+	var received string
+	router := httprouter.New()
+	router.POST("/webhooks", withSignature(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	}))
+
+	now := time.Now()
+	body := `{"type":"invoice.paid"}`
+	replayed := SignRequestBody("current", now, []byte(body))
+
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		status    int
+		message   string
+	}{
+		{"current-secret", body, SignRequestBody("current", now.Add(-time.Second), []byte(body)), http.StatusOK, ""},
+		{"previous-secret", body, SignRequestBody("previous", now.Add(-time.Minute), []byte(body)), http.StatusOK, ""},
+		{"several-signatures", body, SignRequestBody("other", now.Add(-2*time.Second), []byte(body)) + ",v1=" +
+			hex.EncodeToString(signPayload("current", now.Add(-2*time.Second), []byte(body))), http.StatusOK, ""},
+		{"first", body, replayed, http.StatusOK, ""},
+		{"replayed", body, replayed, http.StatusUnauthorized, "The request has already been received"},
+		{"no-signature", body, "", http.StatusUnauthorized, "Request signature not found"},
+		{"unknown-secret", body, SignRequestBody("other", now, []byte(body)), http.StatusUnauthorized, "The request signature isn't valid"},
+		{"tampered-body", `{"type":"invoice.void"}`, SignRequestBody("current", now, []byte(body)), http.StatusUnauthorized, "The request signature isn't valid"},
+		{"malformed", body, "v1=abc", http.StatusUnauthorized, "The request signature isn't valid"},
+		{"expired", body, SignRequestBody("current", now.Add(-10*time.Minute), []byte(body)), http.StatusUnauthorized, "The request signature is expired"},
+		{"too-large", strings.Repeat("a", 65), SignRequestBody("current", now, []byte(strings.Repeat("a", 65))), http.StatusRequestEntityTooLarge, "Request body is too large"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received = ""
+
+			req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(test.body))
+			if test.signature != "" {
+				req.Header.Set("Stripe-Signature", test.signature)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status to be %v, got %v", test.status, w.Code)
+			}
+			if test.status == http.StatusOK {
+				if received != test.body {
+					t.Errorf("expected body %q to be restored, got %q", test.body, received)
+				}
+				return
+			}
+
+			if test.status == http.StatusUnauthorized {
+				challenge := `Signature error="invalid_token", error_description="` + test.message + `"`
+				if test.signature == "" {
+					challenge = "Signature"
+				}
+				if header := w.Header().Get("WWW-Authenticate"); header != challenge {
+					t.Errorf("expected challenge %q, got %q", challenge, header)
+				}
+			}
+
+			var status restutil.Status
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Message != test.message {
+				t.Errorf("expected message %q, got %q", test.message, status.Message)
+			}
+		})
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	now := time.Now()
+
+	if ok, _ := store.Use("nonce", now.Add(time.Hour)); !ok {
+		t.Errorf("expected first use to be accepted")
+	}
+	if ok, _ := store.Use("nonce", now.Add(time.Hour)); ok {
+		t.Errorf("expected second use to be rejected")
+	}
+
+	if ok, _ := store.Use("expired", now.Add(-time.Second)); !ok {
+		t.Errorf("expected first use to be accepted")
+	}
+	if ok, _ := store.Use("expired", now.Add(time.Hour)); !ok {
+		t.Errorf("expected expired nonce to be accepted again")
+	}
+}
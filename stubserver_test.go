@@ -0,0 +1,56 @@
+package nelly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// testServer is a stand-in remote service that counts its calls, and answers
+// with StatusInternalServerError while fail is set, after waiting for delay.
+// The handler is called with the lock held, so the tests change the state it
+// reads with set.
+type testServer struct {
+	*httptest.Server
+
+	lock  sync.Mutex
+	calls int
+	fail  bool
+	delay time.Duration
+}
+
+func newTestServer(handler http.HandlerFunc) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.calls++
+		fail, delay := s.fail, s.delay
+		s.lock.Unlock()
+
+		time.Sleep(delay)
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		handler(w, r)
+	}))
+	return s
+}
+
+// set calls fn with the lock held
+func (s *testServer) set(fn func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fn()
+}
+
+func (s *testServer) callCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls
+}
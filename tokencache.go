@@ -0,0 +1,111 @@
+package nelly
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+// TokenCacheOpts is the configuration of the validated token cache of AuthOpts
+type TokenCacheOpts struct {
+	// Size is the maximum number of validated tokens held by the cache,
+	// the least recently used tokens are evicted first.
+	// Default: 0 (the cache is disabled)
+	Size int
+	// MaxTTL is the maximum time a validated token is held by the cache,
+	// tokens are never held past their 'exp' claim.
+	// Default: 5 minutes
+	MaxTTL time.Duration
+}
+
+// RotatingKeySource is implemented by the KeySources whose keys are rotated.
+// KeysVersion changes whenever the keys are replaced, so the tokens that
+// were validated with the previous keys are validated again.
+type RotatingKeySource interface {
+	KeySource
+	KeysVersion() uint64
+}
+
+// tokenCache caches the identity of validated tokens, keyed by the hash of
+// the token so the cache doesn't hold the credentials themselves
+type tokenCache struct {
+	opts  TokenCacheOpts
+	cache *lruCache
+}
+
+type tokenCacheEntry struct {
+	user        *UserInfo
+	id          tokenID
+	keysVersion uint64
+}
+
+// newTokenCache returns a tokenCache, or nil if the cache is disabled
+func newTokenCache(opts TokenCacheOpts) *tokenCache {
+	if opts.Size <= 0 {
+		return nil
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = 5 * time.Minute
+	}
+
+	return &tokenCache{opts: opts, cache: newLRUCache(opts.Size)}
+}
+
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
+
+// get returns a copy of the identity of token, if it was validated with
+// the current keys
+func (c *tokenCache) get(token string, keysVersion uint64) (*UserInfo, tokenID, bool) {
+	key := tokenCacheKey(token)
+
+	value, ok := c.cache.get(key)
+	if !ok {
+		tokenCacheMisses.Inc()
+		return nil, tokenID{}, false
+	}
+
+	entry := value.(tokenCacheEntry)
+	if entry.keysVersion != keysVersion {
+		c.cache.remove(key)
+		tokenCacheMisses.Inc()
+		return nil, tokenID{}, false
+	}
+
+	tokenCacheHits.Inc()
+	return copyUserInfo(entry.user), entry.id, true
+}
+
+// add stores the identity of the validated token until it's rejected or MaxTTL
+func (c *tokenCache) add(token string, user *UserInfo, id tokenID, keysVersion uint64) {
+	expiresAt := time.Now().Add(c.opts.MaxTTL)
+	if !id.notAfter.IsZero() && id.notAfter.Before(expiresAt) {
+		expiresAt = id.notAfter
+	}
+
+	c.cache.add(tokenCacheKey(token), tokenCacheEntry{user: copyUserInfo(user), id: id, keysVersion: keysVersion}, expiresAt)
+}
+
+// copyUserInfo returns a deep copy of user, so a cached identity isn't changed
+// through the copies returned to the handlers
+func copyUserInfo(user *UserInfo) *UserInfo {
+	copied := *user
+	copied.Groups = copyStrings(user.Groups)
+	copied.Scopes = copyStrings(user.Scopes)
+	copied.Roles = copyStrings(user.Roles)
+	if user.Extra != nil {
+		copied.Extra = make(map[string]interface{}, len(user.Extra))
+		for key, value := range user.Extra {
+			copied.Extra[key] = value
+		}
+	}
+	return &copied
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(values)), values...)
+}
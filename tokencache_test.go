@@ -0,0 +1,182 @@
+package nelly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// countingKeySource is a RotatingKeySource that counts the verification key lookups
+type countingKeySource struct {
+	lock    sync.Mutex
+	secret  HMACSecret
+	version uint64
+	lookups int
+}
+
+func (s *countingKeySource) VerificationKey(token *jwt.Token) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lookups++
+	return s.secret.VerificationKey(token)
+}
+
+func (s *countingKeySource) KeysVersion() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+func (s *countingKeySource) rotate(secret string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.secret = HMACSecret(secret)
+	s.version++
+}
+
+func (s *countingKeySource) lookupCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lookups
+}
+
+func TestWithAuthTokenCache(t *testing.T) {
+	keys := &countingKeySource{secret: HMACSecret("secret")}
+
+	var subject string
+	router := httprouter.New()
+	router.GET("/v1", WithAuth(AuthOpts{
+		Keys:       keys,
+		TokenCache: TokenCacheOpts{Size: 10},
+	})(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, _ := UserFrom(r.Context())
+		subject = user.Subject
+		// the cached identity can't be changed by the handlers
+		user.Subject = "changed"
+	}))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for i := 0; i < 3; i++ {
+		if status := doTestRequest(t, ts.URL+"/v1", token); status != http.StatusOK {
+			t.Fatalf("expected status to be %v, got %v", http.StatusOK, status)
+		}
+		if subject != "user" {
+			t.Errorf("expected subject %q, got %q", "user", subject)
+		}
+	}
+	if keys.lookupCount() != 1 {
+		t.Errorf("expected token to be verified once, got %d", keys.lookupCount())
+	}
+
+	// invalid tokens are never cached
+	invalid := signTestToken(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"sub": "user"})
+	for i := 0; i < 2; i++ {
+		if status := doTestRequest(t, ts.URL+"/v1", invalid); status != http.StatusUnauthorized {
+			t.Errorf("expected status to be %v, got %v", http.StatusUnauthorized, status)
+		}
+	}
+	if keys.lookupCount() != 3 {
+		t.Errorf("expected invalid token to be verified twice, got %d", keys.lookupCount()-1)
+	}
+
+	// the token is validated again with the rotated keys
+	keys.rotate("rotated")
+	if status := doTestRequest(t, ts.URL+"/v1", token); status != http.StatusUnauthorized {
+		t.Errorf("expected status to be %v, got %v", http.StatusUnauthorized, status)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	cache := newTokenCache(TokenCacheOpts{Size: 10, MaxTTL: time.Hour})
+
+	cache.add("expired", &UserInfo{Subject: "user"}, tokenID{notAfter: time.Now().Add(-time.Second)}, 0)
+	if _, _, ok := cache.get("expired", 0); ok {
+		t.Errorf("expected expired token not to be cached")
+	}
+
+	cache.add("token", &UserInfo{Subject: "user"}, tokenID{}, 1)
+	if _, _, ok := cache.get("token", 2); ok {
+		t.Errorf("expected token of previous keys not to be cached")
+	}
+	if _, _, ok := cache.get("token", 1); ok {
+		t.Errorf("expected token of previous keys to be removed")
+	}
+
+	cache = newTokenCache(TokenCacheOpts{Size: 10, MaxTTL: time.Millisecond})
+	cache.add("token", &UserInfo{Subject: "user"}, tokenID{notAfter: time.Now().Add(time.Hour)}, 0)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, ok := cache.get("token", 0); ok {
+		t.Errorf("expected token to be held at most MaxTTL")
+	}
+
+	if newTokenCache(TokenCacheOpts{}) != nil {
+		t.Errorf("expected cache to be disabled by default")
+	}
+}
+
+func TestTokenCacheCopies(t *testing.T) {
+	cache := newTokenCache(TokenCacheOpts{Size: 10})
+
+	user := &UserInfo{Subject: "user", Groups: []string{"a", "b"}, Scopes: []string{"read"}, Roles: []string{"admin"}, Extra: map[string]interface{}{"tenant": "t1"}}
+	cache.add("token", user, tokenID{}, 0)
+	user.Groups[0] = "added"
+	user.Extra["added"] = true
+
+	for i := 0; i < 2; i++ {
+		cached, _, ok := cache.get("token", 0)
+		if !ok {
+			t.Fatalf("expected token to be cached")
+		}
+		if !reflect.DeepEqual(cached, &UserInfo{Subject: "user", Groups: []string{"a", "b"}, Scopes: []string{"read"}, Roles: []string{"admin"}, Extra: map[string]interface{}{"tenant": "t1"}}) {
+			t.Fatalf("expected cached identity to be unchanged, got %+v", cached)
+		}
+
+		cached.Groups[0] = "changed"
+		cached.Groups = append(cached.Groups[:1], "appended")
+		cached.Scopes[0] = "changed"
+		cached.Roles[0] = "changed"
+		cached.Extra["tenant"] = "changed"
+		cached.Extra["added"] = true
+	}
+}
+
+func TestJWKSCacheKeysVersion(t *testing.T) {
+	_, jwk1 := newTestRSAKey(t, "key-1")
+	_, jwk2 := newTestRSAKey(t, "key-2")
+	server := newTestJWKSServer(jwk1)
+	defer server.Close()
+
+	cache := NewJWKSCache(JWKSOpts{URL: server.URL})
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	version := cache.KeysVersion()
+
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cache.KeysVersion() != version {
+		t.Errorf("expected version of unchanged keys to be %d, got %d", version, cache.KeysVersion())
+	}
+
+	server.setKeys(jwk1, jwk2)
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cache.KeysVersion() == version {
+		t.Errorf("expected version to change with the rotated keys")
+	}
+}
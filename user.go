@@ -0,0 +1,216 @@
+package nelly
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type userContextKeyType int
+
+// userContextKey is used to store the authenticated UserInfo in the request context.
+const userContextKey userContextKeyType = iota
+
+// UserInfo describes the authenticated user of a request
+type UserInfo struct {
+	// Subject uniquely identifies the user, e.g. the 'sub' claim
+	Subject string
+	// Groups the user belongs to
+	Groups []string
+	// Scopes granted to the credentials of the user
+	Scopes []string
+	// Roles granted to the user
+	Roles []string
+	// Issuer of the credentials, e.g. the 'iss' claim
+	Issuer string
+	// Tenant resolved from the issuer of the credentials by a multi-issuer authenticator
+	Tenant string
+	// Expiry of the credentials, zero if they don't expire
+	Expiry time.Time
+	// Extra holds any additional claims of the credentials
+	Extra map[string]interface{}
+}
+
+// AnonymousUser and AnonymousGroup are the Subject and group of the anonymous
+// user, e.g. of the requests authenticated with FailurePolicyAnonymous
+const (
+	AnonymousUser  = "system:anonymous"
+	AnonymousGroup = "system:unauthenticated"
+)
+
+// WithUser returns a copy of ctx in which the user is stored
+func WithUser(ctx context.Context, user *UserInfo) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFrom returns the authenticated user stored in ctx by the authentication handlers
+func UserFrom(ctx context.Context) (*UserInfo, bool) {
+	user, ok := ctx.Value(userContextKey).(*UserInfo)
+	return user, ok
+}
+
+// TenantFrom returns the tenant of the authenticated user stored in ctx
+func TenantFrom(ctx context.Context) (string, bool) {
+	user, ok := UserFrom(ctx)
+	if !ok || user.Tenant == "" {
+		return "", false
+	}
+	return user.Tenant, true
+}
+
+// ClaimsMapper decides how the claims of a validated JWT token become the
+// UserInfo of the request
+type ClaimsMapper func(claims jwt.MapClaims) (*UserInfo, error)
+
+// ClaimNames are the names of the claims that are mapped to UserInfo by
+// NewClaimsMapper. The values of all the listed claims of a field are merged.
+// Nested claims are addressed with dots, e.g. "realm_access.roles", unless
+// a top-level claim has the whole name (like Auth0 namespaced claims).
+type ClaimNames struct {
+	Subject string
+	Groups  []string
+	Scopes  []string
+	Roles   []string
+}
+
+var (
+	// DefaultClaimNames are the claim names used by DefaultClaimsMapper
+	DefaultClaimNames = ClaimNames{
+		Subject: "sub",
+		Groups:  []string{"groups"},
+		Scopes:  []string{"scope", "scp"},
+		Roles:   []string{"roles"},
+	}
+
+	// Auth0ClaimNames are the claim names of Auth0 access tokens, where the
+	// RBAC permissions are mapped to Roles
+	Auth0ClaimNames = ClaimNames{
+		Subject: "sub",
+		Scopes:  []string{"scope"},
+		Roles:   []string{"permissions"},
+	}
+
+	// KeycloakClaimNames are the claim names of Keycloak access tokens, where
+	// the realm roles are mapped to Roles
+	KeycloakClaimNames = ClaimNames{
+		Subject: "sub",
+		Groups:  []string{"groups"},
+		Scopes:  []string{"scope"},
+		Roles:   []string{"realm_access.roles"},
+	}
+
+	// AzureADClaimNames are the claim names of Azure AD access tokens, where
+	// the delegated permissions are mapped to Scopes and the app roles to Roles
+	AzureADClaimNames = ClaimNames{
+		Subject: "sub",
+		Groups:  []string{"groups"},
+		Scopes:  []string{"scp"},
+		Roles:   []string{"roles"},
+	}
+)
+
+// DefaultClaimsMapper maps 'sub' to Subject, 'groups' to Groups, 'scope' (a space
+// separated string) and 'scp' to Scopes, 'roles' to Roles, 'iss' to Issuer and
+// 'exp' to Expiry. The remaining claims are copied to Extra.
+var DefaultClaimsMapper = NewClaimsMapper(DefaultClaimNames)
+
+// NewClaimsMapper returns a ClaimsMapper that maps the claims with the given
+// names to UserInfo, 'iss' to Issuer and 'exp' to Expiry. The remaining
+// top-level claims are copied to Extra.
+func NewClaimsMapper(names ClaimNames) ClaimsMapper {
+
+	mapped := map[string]bool{"iss": true, "exp": true, names.Subject: true}
+	for _, fields := range [][]string{names.Groups, names.Scopes, names.Roles} {
+		for _, name := range fields {
+			mapped[strings.SplitN(name, ".", 2)[0]] = true
+			mapped[name] = true
+		}
+	}
+
+	return func(claims jwt.MapClaims) (*UserInfo, error) {
+		user := &UserInfo{
+			Extra: map[string]interface{}{},
+		}
+
+		user.Subject, _ = lookupClaim(claims, names.Subject).(string)
+		user.Issuer, _ = claims["iss"].(string)
+		user.Groups = claimsStrings(claims, names.Groups)
+		user.Scopes = claimsStrings(claims, names.Scopes)
+		user.Roles = claimsStrings(claims, names.Roles)
+		user.Expiry = claimTime(claims["exp"])
+
+		for name, value := range claims {
+			if !mapped[name] {
+				user.Extra[name] = value
+			}
+		}
+
+		return user, nil
+	}
+}
+
+// lookupClaim returns the claim with the given name, which may address a
+// nested claim with dots
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if value, ok := claims[name]; ok {
+		return value
+	}
+
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	nested, ok := claims[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	return lookupClaim(nested, parts[1])
+}
+
+// claimsStrings merges the values of the claims with the given names
+func claimsStrings(claims jwt.MapClaims, names []string) []string {
+	var values []string
+	for _, name := range names {
+		values = append(values, claimStrings(lookupClaim(claims, name))...)
+	}
+	return values
+}
+
+// claimStrings returns the values of a claim that is either a space separated
+// string or an array of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimTime returns the time of a NumericDate claim, or zero if it is not set
+func claimTime(claim interface{}) time.Time {
+	switch v := claim.(type) {
+	case float64:
+		return time.Unix(int64(v), 0)
+	case int64:
+		return time.Unix(v, 0)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0)
+		}
+	}
+	return time.Time{}
+}
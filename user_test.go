@@ -0,0 +1,206 @@
+package nelly
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestUserFrom(t *testing.T) {
+	if _, ok := UserFrom(context.Background()); ok {
+		t.Errorf("expected no user in empty context")
+	}
+
+	user := &UserInfo{Subject: "user"}
+	got, ok := UserFrom(WithUser(context.Background(), user))
+	if !ok || got != user {
+		t.Errorf("expected %v, got %v", user, got)
+	}
+}
+
+func TestDefaultClaimsMapper(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected *UserInfo
+	}{
+		{
+			name: "scope",
+			claims: jwt.MapClaims{
+				"sub":    "user",
+				"iss":    "issuer",
+				"exp":    float64(exp.Unix()),
+				"groups": []interface{}{"admins", "users"},
+				"scope":  "read write",
+				"email":  "user@example.com",
+			},
+			expected: &UserInfo{
+				Subject: "user",
+				Issuer:  "issuer",
+				Expiry:  exp,
+				Groups:  []string{"admins", "users"},
+				Scopes:  []string{"read", "write"},
+				Extra:   map[string]interface{}{"email": "user@example.com"},
+			},
+		},
+		{
+			name: "scp",
+			claims: jwt.MapClaims{
+				"sub": "user",
+				"scp": []interface{}{"read", "write"},
+			},
+			expected: &UserInfo{
+				Subject: "user",
+				Scopes:  []string{"read", "write"},
+				Extra:   map[string]interface{}{},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := DefaultClaimsMapper(test.claims)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(user, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, user)
+			}
+		})
+	}
+}
+
+func TestNewClaimsMapper(t *testing.T) {
+	tests := []struct {
+		name   string
+		names  ClaimNames
+		claims jwt.MapClaims
+		scopes []string
+		roles  []string
+		extra  map[string]interface{}
+	}{
+		{
+			name:  "auth0",
+			names: Auth0ClaimNames,
+			claims: jwt.MapClaims{
+				"scope":       "read:users",
+				"permissions": []interface{}{"delete:users"},
+			},
+			scopes: []string{"read:users"},
+			roles:  []string{"delete:users"},
+			extra:  map[string]interface{}{},
+		},
+		{
+			name: "auth0-namespaced",
+			names: ClaimNames{
+				Subject: "sub",
+				Roles:   []string{"https://example.com/roles"},
+			},
+			claims: jwt.MapClaims{
+				"https://example.com/roles": []interface{}{"admin"},
+			},
+			roles: []string{"admin"},
+			extra: map[string]interface{}{},
+		},
+		{
+			name:  "keycloak",
+			names: KeycloakClaimNames,
+			claims: jwt.MapClaims{
+				"scope":        "openid profile",
+				"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+				"azp":          "client",
+			},
+			scopes: []string{"openid", "profile"},
+			roles:  []string{"admin", "user"},
+			extra:  map[string]interface{}{"azp": "client"},
+		},
+		{
+			name:  "azure-ad",
+			names: AzureADClaimNames,
+			claims: jwt.MapClaims{
+				"scp":   "User.Read",
+				"roles": []interface{}{"Task.Write"},
+			},
+			scopes: []string{"User.Read"},
+			roles:  []string{"Task.Write"},
+			extra:  map[string]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := NewClaimsMapper(test.names)(test.claims)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(user.Scopes, test.scopes) {
+				t.Errorf("expected scopes %v, got %v", test.scopes, user.Scopes)
+			}
+			if !reflect.DeepEqual(user.Roles, test.roles) {
+				t.Errorf("expected roles %v, got %v", test.roles, user.Roles)
+			}
+			if !reflect.DeepEqual(user.Extra, test.extra) {
+				t.Errorf("expected extra %v, got %v", test.extra, user.Extra)
+			}
+		})
+	}
+}
+
+func TestWithAuthUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		claimsMapper ClaimsMapper
+		status       int
+		subject      string
+	}{
+		{"default", nil, http.StatusOK, "user"},
+		{"custom", func(claims jwt.MapClaims) (*UserInfo, error) {
+			return &UserInfo{Subject: claims["email"].(string)}, nil
+		}, http.StatusOK, "user@example.com"},
+		{"error", func(claims jwt.MapClaims) (*UserInfo, error) {
+			return nil, errors.New("invalid claims")
+		}, http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withAuth := WithAuth(AuthOpts{
+				Keys:         HMACSecret("secret"),
+				Algorithms:   []string{"HS256"},
+				ClaimsMapper: test.claimsMapper,
+			})
+
+			var subject string
+			router := httprouter.New()
+			router.GET("/v1", withAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+				if user, ok := UserFrom(r.Context()); ok {
+					subject = user.Subject
+				}
+			}))
+
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			token := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{
+				"sub":   "user",
+				"email": "user@example.com",
+			})
+
+			if status := doTestRequest(t, ts.URL+"/v1", token); status != test.status {
+				t.Errorf("expected status to be %v, got %v", test.status, status)
+			}
+			if subject != test.subject {
+				t.Errorf("expected subject %q, got %q", test.subject, subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package nelly
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrTokenExpired is returned for tokens whose 'exp' has passed
+	ErrTokenExpired error = newTokenError("Token is expired")
+	// ErrTokenNotValidYet is returned for tokens whose 'nbf' or 'iat' is in the future
+	ErrTokenNotValidYet error = newTokenError("Token is not valid yet")
+	// ErrTokenTooOld is returned for tokens issued longer than ValidationOpts.MaxAge ago
+	ErrTokenTooOld error = newTokenError("Token is too old")
+	// ErrInvalidAudience is returned for tokens without the expected 'aud'
+	ErrInvalidAudience error = newTokenError("Invalid audience")
+	// ErrInvalidIssuer is returned for tokens without the expected 'iss'
+	ErrInvalidIssuer error = newTokenError("Invalid issuer")
+)
+
+// ClaimsValidator validates the claims of a token whose signature is verified
+type ClaimsValidator func(claims jwt.MapClaims) error
+
+// ValidationOpts is the configuration of the claims validation of AuthOpts
+type ValidationOpts struct {
+	// RequireAudience rejects the tokens without 'aud' claim, otherwise
+	// they're accepted whatever the expected Audience is.
+	// Default: false
+	RequireAudience bool
+	// RequireIssuer rejects the tokens without 'iss' claim, otherwise
+	// they're accepted whatever the expected Issuer is.
+	// Default: false
+	RequireIssuer bool
+	// RequireExpiry rejects the tokens without 'exp' claim.
+	// Default: false
+	RequireExpiry bool
+	// Leeway is the allowed clock skew when checking 'exp', 'nbf' and 'iat'.
+	// Default: 0
+	Leeway time.Duration
+	// MaxAge is the maximum time since the token was issued ('iat'), tokens
+	// without 'iat' are rejected if it's set.
+	// Default: 0 (the age of tokens is not checked)
+	MaxAge time.Duration
+	// RequiredClaims are the names of the claims that the token must have,
+	// a name may address a nested claim with dots, e.g. "realm_access.roles"
+	RequiredClaims []string
+	// Validators are called in order after the other claims are validated
+	Validators []ClaimsValidator
+}
+
+// validateClaims checks the time based claims, the required claims and the
+// validators against claims. 'aud' and 'iss' are checked before the signature.
+func (v ValidationOpts) validateClaims(claims jwt.MapClaims, now time.Time) error {
+
+	exp, err := numericDate(claims, "exp", v.RequireExpiry)
+	if err != nil {
+		return err
+	}
+	if !exp.IsZero() && now.After(exp.Add(v.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	nbf, err := numericDate(claims, "nbf", false)
+	if err != nil {
+		return err
+	}
+	if !nbf.IsZero() && now.Add(v.Leeway).Before(nbf) {
+		return ErrTokenNotValidYet
+	}
+
+	iat, err := numericDate(claims, "iat", v.MaxAge > 0)
+	if err != nil {
+		return err
+	}
+	if !iat.IsZero() && now.Add(v.Leeway).Before(iat) {
+		return ErrTokenNotValidYet
+	}
+	if v.MaxAge > 0 && now.After(iat.Add(v.MaxAge+v.Leeway)) {
+		return ErrTokenTooOld
+	}
+
+	for _, name := range v.RequiredClaims {
+		if lookupClaim(claims, name) == nil {
+			return newTokenError(fmt.Sprintf("Missing required claim %s", name))
+		}
+	}
+
+	for _, validator := range v.Validators {
+		if err := validator(claims); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notAfter returns the time after which the validated claims are rejected,
+// or zero if they never expire
+func (v ValidationOpts) notAfter(claims jwt.MapClaims) time.Time {
+	notAfter := claimTime(claims["exp"])
+	if !notAfter.IsZero() {
+		notAfter = notAfter.Add(v.Leeway)
+	}
+
+	if v.MaxAge > 0 {
+		tooOld := claimTime(claims["iat"]).Add(v.MaxAge + v.Leeway)
+		if notAfter.IsZero() || tooOld.Before(notAfter) {
+			notAfter = tooOld
+		}
+	}
+
+	return notAfter
+}
+
+// numericDate returns the time of the NumericDate claim name, or zero if it's
+// not set and not required
+func numericDate(claims jwt.MapClaims, name string, required bool) (time.Time, error) {
+	value, ok := claims[name]
+	if !ok {
+		if required {
+			return time.Time{}, newTokenError(fmt.Sprintf("Missing required claim %s", name))
+		}
+		return time.Time{}, nil
+	}
+
+	t := claimTime(value)
+	if t.IsZero() {
+		return time.Time{}, newTokenError(fmt.Sprintf("Invalid %s claim", name))
+	}
+	return t, nil
+}
+
+// verifyAudience checks that the 'aud' claim, a string or an array of strings,
+// contains audience. The claim isn't checked if audience is empty.
+func verifyAudience(claims jwt.MapClaims, audience string, required bool) bool {
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != "" {
+			audiences = []string{aud}
+		}
+	case nil:
+	default:
+		if audiences = claimStrings(aud); audiences == nil {
+			// An 'aud' claim of another type is never valid
+			return false
+		}
+	}
+
+	if len(audiences) == 0 {
+		return !required
+	}
+	if audience == "" {
+		return true
+	}
+	for _, aud := range audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIssuer checks that the 'iss' claim is issuer. The claim isn't checked
+// if issuer is empty.
+func verifyIssuer(claims jwt.MapClaims, issuer string, required bool) bool {
+	switch iss := claims["iss"].(type) {
+	case nil:
+		return !required
+	case string:
+		if iss == "" {
+			return !required
+		}
+		return issuer == "" || iss == issuer
+	}
+	// An 'iss' claim of another type is never valid
+	return false
+}
@@ -0,0 +1,123 @@
+package nelly
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestValidateClaims(t *testing.T) {
+	now := time.Now()
+	errCustom := errors.New("custom")
+
+	tests := []struct {
+		name   string
+		opts   ValidationOpts
+		claims jwt.MapClaims
+		err    error
+	}{
+		{"empty", ValidationOpts{}, jwt.MapClaims{}, nil},
+		{"valid", ValidationOpts{}, jwt.MapClaims{"exp": float64(now.Add(time.Minute).Unix()), "nbf": float64(now.Unix()), "iat": float64(now.Unix())}, nil},
+		{"expired", ValidationOpts{}, jwt.MapClaims{"exp": float64(now.Add(-time.Minute).Unix())}, ErrTokenExpired},
+		{"expired-leeway", ValidationOpts{Leeway: 2 * time.Minute}, jwt.MapClaims{"exp": float64(now.Add(-time.Minute).Unix())}, nil},
+		{"not-valid-yet", ValidationOpts{}, jwt.MapClaims{"nbf": float64(now.Add(time.Minute).Unix())}, ErrTokenNotValidYet},
+		{"not-valid-yet-leeway", ValidationOpts{Leeway: 2 * time.Minute}, jwt.MapClaims{"nbf": float64(now.Add(time.Minute).Unix())}, nil},
+		{"issued-in-future", ValidationOpts{}, jwt.MapClaims{"iat": float64(now.Add(time.Minute).Unix())}, ErrTokenNotValidYet},
+		{"too-old", ValidationOpts{MaxAge: time.Hour}, jwt.MapClaims{"iat": float64(now.Add(-2 * time.Hour).Unix())}, ErrTokenTooOld},
+		{"max-age", ValidationOpts{MaxAge: time.Hour}, jwt.MapClaims{"iat": float64(now.Add(-time.Minute).Unix())}, nil},
+		{"max-age-without-iat", ValidationOpts{MaxAge: time.Hour}, jwt.MapClaims{}, errors.New("Missing required claim iat")},
+		{"require-expiry", ValidationOpts{RequireExpiry: true}, jwt.MapClaims{}, errors.New("Missing required claim exp")},
+		{"invalid-exp", ValidationOpts{}, jwt.MapClaims{"exp": "tomorrow"}, errors.New("Invalid exp claim")},
+		{"required-claims", ValidationOpts{RequiredClaims: []string{"sub", "realm_access.roles"}}, jwt.MapClaims{"sub": "user", "realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}}, nil},
+		{"missing-required-claim", ValidationOpts{RequiredClaims: []string{"sub", "tid"}}, jwt.MapClaims{"sub": "user"}, errors.New("Missing required claim tid")},
+		{"validators", ValidationOpts{Validators: []ClaimsValidator{
+			func(jwt.MapClaims) error { return nil },
+			func(jwt.MapClaims) error { return errCustom },
+		}}, jwt.MapClaims{}, errCustom},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.opts.validateClaims(test.claims, now)
+			if test.err == nil && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != nil && (err == nil || err.Error() != test.err.Error()) {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyAudienceAndIssuer(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		required bool
+		valid    bool
+	}{
+		{"missing", jwt.MapClaims{}, false, true},
+		{"missing-required", jwt.MapClaims{}, true, false},
+		{"string", jwt.MapClaims{"aud": "api", "iss": "issuer"}, true, true},
+		{"wrong", jwt.MapClaims{"aud": "other", "iss": "other"}, false, false},
+		{"array", jwt.MapClaims{"aud": []interface{}{"other", "api"}, "iss": "issuer"}, true, true},
+		{"array-wrong", jwt.MapClaims{"aud": []interface{}{"other"}, "iss": "other"}, false, false},
+		{"invalid-type", jwt.MapClaims{"aud": 1.0, "iss": 1.0}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := verifyAudience(test.claims, "api", test.required); valid != test.valid {
+				t.Errorf("expected audience valid to be %v, got %v", test.valid, valid)
+			}
+			if valid := verifyIssuer(test.claims, "issuer", test.required); valid != test.valid {
+				t.Errorf("expected issuer valid to be %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestWithAuthValidation(t *testing.T) {
+	authenticator := NewJWTAuthenticator(AuthOpts{
+		Keys:     HMACSecret("secret"),
+		Audience: "api",
+		Issuer:   "issuer",
+		Validation: ValidationOpts{
+			RequireAudience: true,
+			RequireIssuer:   true,
+			Leeway:          time.Minute,
+		},
+	})
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    error
+	}{
+		{"valid", jwt.MapClaims{"aud": "api", "iss": "issuer"}, nil},
+		{"expired-in-leeway", jwt.MapClaims{"aud": "api", "iss": "issuer", "exp": now.Add(-30 * time.Second).Unix()}, nil},
+		{"expired", jwt.MapClaims{"aud": "api", "iss": "issuer", "exp": now.Add(-2 * time.Minute).Unix()}, ErrTokenExpired},
+		{"not-valid-yet", jwt.MapClaims{"aud": "api", "iss": "issuer", "nbf": now.Add(2 * time.Minute).Unix()}, ErrTokenNotValidYet},
+		{"missing-audience", jwt.MapClaims{"iss": "issuer"}, ErrInvalidAudience},
+		{"wrong-audience", jwt.MapClaims{"aud": []string{"other"}, "iss": "issuer"}, ErrInvalidAudience},
+		{"missing-issuer", jwt.MapClaims{"aud": "api"}, ErrInvalidIssuer},
+		{"wrong-issuer", jwt.MapClaims{"aud": "api", "iss": "other"}, ErrInvalidIssuer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", test.claims))
+
+			_, _, err := authenticator.AuthenticateRequest(req)
+			if err != test.err {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package nelly
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// FailurePolicy decides how requests are authenticated when the webhook fails
+type FailurePolicy int
+
+const (
+	// FailurePolicyDeny rejects the requests when the webhook fails
+	FailurePolicyDeny FailurePolicy = iota
+	// FailurePolicyAnonymous authenticates the requests as the anonymous user
+	// when the webhook fails, the authorization handlers decide whether the
+	// anonymous user is allowed
+	FailurePolicyAnonymous
+)
+
+// WebhookOpts is the configuration that will be used by WithWebhookAuth and NewWebhookAuthenticator
+type WebhookOpts struct {
+	// URL of the webhook, which receives a TokenReview and returns its status
+	URL string
+	// Audiences are sent in the TokenReview spec, the token must be valid for
+	// at least one of them. Not checked if empty.
+	Audiences []string
+	// Extractors extract the token from the request, they are tried in order
+	// until a token is found.
+	// Default: FromHeader("Authorization", "Bearer")
+	Extractors []TokenExtractor
+	// ErrorRenderer writes the response of the requests that failed to be
+	// authenticated.
+	// Default: DefaultErrorRenderer
+	ErrorRenderer ErrorRenderer
+	// FailurePolicy decides how requests are authenticated when the webhook
+	// can't be reached or returns an error.
+	// Default: FailurePolicyDeny
+	FailurePolicy FailurePolicy
+	// Timeout of the requests to the webhook.
+	// Default: 10 seconds
+	Timeout time.Duration
+	// CacheSize is the maximum number of reviews held by each of the success
+	// and failure caches.
+	// Default: 1000
+	CacheSize int
+	// CacheTTL is the time an authenticated token is cached.
+	// Default: 2 minutes
+	CacheTTL time.Duration
+	// NegativeCacheTTL is the time a rejected token is cached.
+	// Default: 30 seconds
+	NegativeCacheTTL time.Duration
+	// Client is the HTTP client used to call the webhook, its Timeout is
+	// replaced by opts.Timeout.
+	// Default: an http.Client of the default transport
+	Client *http.Client
+}
+
+// tokenReview is the TokenReview (authentication.k8s.io/v1) sent to the webhook
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool                `json:"authenticated"`
+	User          tokenReviewUserInfo `json:"user"`
+	Audiences     []string            `json:"audiences,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+type tokenReviewUserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra"`
+}
+
+// webhookAuthenticator authenticates requests with a token reviewed by a webhook
+type webhookAuthenticator struct {
+	opts         WebhookOpts
+	client       *http.Client
+	successCache *lruCache
+	failureCache *lruCache
+}
+
+// NewWebhookAuthenticator returns an Authenticator that sends the token of
+// the request to a webhook in a TokenReview, like the Kubernetes webhook token
+// authenticator. The user, groups and extra fields of the review are the
+// UserInfo of the request, its 'uid' is in Extra. The reviews are cached by
+// token in separate success and failure caches.
+func NewWebhookAuthenticator(opts WebhookOpts) Authenticator {
+
+	if opts.URL == "" {
+		klog.Fatalf("Webhook authentication requires the URL of the webhook")
+	}
+	if len(opts.Extractors) == 0 {
+		opts.Extractors = defaultExtractors
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 1000
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = 2 * time.Minute
+	}
+	if opts.NegativeCacheTTL <= 0 {
+		opts.NegativeCacheTTL = 30 * time.Second
+	}
+
+	client := &http.Client{}
+	if opts.Client != nil {
+		*client = *opts.Client
+	}
+	client.Timeout = opts.Timeout
+
+	return &webhookAuthenticator{
+		opts:         opts,
+		client:       client,
+		successCache: newLRUCache(opts.CacheSize),
+		failureCache: newLRUCache(opts.CacheSize),
+	}
+}
+
+// AuthenticateRequest implements Authenticator
+func (a *webhookAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	token, err := extractToken(a.opts.Extractors, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if token == "" {
+		return nil, false, nil
+	}
+
+	key := tokenCacheKey(token)
+	if value, ok := a.successCache.get(key); ok {
+		return copyUserInfo(value.(*UserInfo)), true, nil
+	}
+	if value, ok := a.failureCache.get(key); ok {
+		return nil, false, value.(error)
+	}
+
+	status, err := a.review(token)
+	if err != nil {
+		// Failures of the webhook are not cached
+		klog.Errorf("Failed to review token with %s: %v", a.opts.URL, err)
+		if a.opts.FailurePolicy == FailurePolicyAnonymous {
+			return &UserInfo{Subject: AnonymousUser, Groups: []string{AnonymousGroup}, Extra: map[string]interface{}{}}, true, nil
+		}
+		return nil, false, errors.New("Failed to review token")
+	}
+
+	user, err := a.validate(status)
+	if err != nil {
+		a.failureCache.add(key, err, time.Now().Add(a.opts.NegativeCacheTTL))
+		return nil, false, err
+	}
+
+	a.successCache.add(key, copyUserInfo(user), time.Now().Add(a.opts.CacheTTL))
+
+	return user, true, nil
+}
+
+// review posts the TokenReview of the token to the webhook and returns its status
+func (a *webhookAuthenticator) review(token string) (*tokenReviewStatus, error) {
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: a.opts.Audiences},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code %d from webhook", resp.StatusCode)
+	}
+
+	review := tokenReview{}
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return nil, err
+	}
+
+	return &review.Status, nil
+}
+
+// validate checks the status of the review and maps it to the user
+func (a *webhookAuthenticator) validate(status *tokenReviewStatus) (*UserInfo, error) {
+	if !status.Authenticated {
+		if status.Error != "" {
+			klog.V(2).Infof("Token rejected by webhook %s: %s", a.opts.URL, status.Error)
+		}
+		return nil, errInvalidToken
+	}
+
+	if len(a.opts.Audiences) != 0 && len(status.Audiences) != 0 && !intersects(a.opts.Audiences, status.Audiences) {
+		return nil, ErrInvalidAudience
+	}
+
+	user := &UserInfo{
+		Subject: status.User.Username,
+		Groups:  status.User.Groups,
+		Extra:   map[string]interface{}{},
+	}
+	for name, values := range status.User.Extra {
+		user.Extra[name] = values
+	}
+	if status.User.UID != "" {
+		user.Extra["uid"] = status.User.UID
+	}
+
+	return user, nil
+}
+
+// intersects returns true if a and b have a common value
+func intersects(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithWebhookAuth handler authenticates requests with token reviewed by a
+// webhook, see NewWebhookAuthenticator
+func WithWebhookAuth(opts WebhookOpts) Handler {
+	return WithAuthenticationOpts(AuthenticationOpts{ErrorRenderer: opts.ErrorRenderer}, NewWebhookAuthenticator(opts))
+}
@@ -0,0 +1,165 @@
+package nelly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testWebhookServer is a stand-in TokenReview webhook that answers with the
+// status registered for each token
+type testWebhookServer struct {
+	*testServer
+
+	statuses map[string]tokenReviewStatus
+}
+
+func newTestWebhookServer() *testWebhookServer {
+	s := &testWebhookServer{statuses: map[string]tokenReviewStatus{}}
+	s.testServer = newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		review := tokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Kind != "TokenReview" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		review.Status = s.statuses[review.Spec.Token]
+		json.NewEncoder(w).Encode(review)
+	})
+	return s
+}
+
+func authenticateTestToken(authenticator Authenticator, token string) (*UserInfo, bool, error) {
+	req := httptest.NewRequest(http.MethodGet, "/v1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return authenticator.AuthenticateRequest(req)
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	server := newTestWebhookServer()
+	defer server.Close()
+
+	server.statuses["valid"] = tokenReviewStatus{
+		Authenticated: true,
+		User: tokenReviewUserInfo{
+			Username: "jane",
+			UID:      "42",
+			Groups:   []string{"developers"},
+			Extra:    map[string][]string{"team": {"platform"}},
+		},
+		Audiences: []string{"api"},
+	}
+	server.statuses["other-audience"] = tokenReviewStatus{Authenticated: true, User: tokenReviewUserInfo{Username: "jane"}, Audiences: []string{"other"}}
+	server.statuses["invalid"] = tokenReviewStatus{Authenticated: false, Error: "token expired"}
+
+	authenticator := NewWebhookAuthenticator(WebhookOpts{URL: server.URL, Audiences: []string{"api"}})
+
+	user, ok, err := authenticateTestToken(authenticator, "valid")
+	if !ok || err != nil {
+		t.Fatalf("expected token to be valid, got %v", err)
+	}
+	expected := &UserInfo{
+		Subject: "jane",
+		Groups:  []string{"developers"},
+		Extra:   map[string]interface{}{"team": []string{"platform"}, "uid": "42"},
+	}
+	if !reflect.DeepEqual(user, expected) {
+		t.Errorf("expected user %+v, got %+v", expected, user)
+	}
+
+	for _, token := range []string{"invalid", "other-audience"} {
+		if _, ok, err := authenticateTestToken(authenticator, token); ok || err == nil {
+			t.Errorf("expected token %q to be rejected", token)
+		}
+	}
+
+	// The reviews are cached, the cached user can't be changed through the
+	// returned users
+	user.Groups[0] = "changed"
+	user.Extra["uid"] = "changed"
+	calls := server.callCount()
+	for _, token := range []string{"valid", "invalid", "other-audience"} {
+		authenticateTestToken(authenticator, token)
+	}
+	if server.callCount() != calls {
+		t.Errorf("expected reviews to be cached, got %d calls", server.callCount()-calls)
+	}
+	if user, _, _ := authenticateTestToken(authenticator, "valid"); !reflect.DeepEqual(user, expected) {
+		t.Errorf("expected cached user %+v, got %+v", expected, user)
+	}
+}
+
+func TestWebhookAuthenticatorCacheTTL(t *testing.T) {
+	server := newTestWebhookServer()
+	defer server.Close()
+
+	server.statuses["token"] = tokenReviewStatus{Authenticated: true, User: tokenReviewUserInfo{Username: "jane"}}
+
+	authenticator := NewWebhookAuthenticator(WebhookOpts{URL: server.URL, CacheTTL: 50 * time.Millisecond, NegativeCacheTTL: time.Hour})
+
+	if _, ok, _ := authenticateTestToken(authenticator, "token"); !ok {
+		t.Fatalf("expected token to be valid")
+	}
+
+	// the token is revoked by the webhook once the success cache expired
+	server.set(func() { server.statuses["token"] = tokenReviewStatus{} })
+	if _, ok, _ := authenticateTestToken(authenticator, "token"); !ok {
+		t.Errorf("expected token to be cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok, _ := authenticateTestToken(authenticator, "token"); ok {
+		t.Errorf("expected token to be reviewed again")
+	}
+
+	// the rejection is cached for the NegativeCacheTTL
+	server.set(func() {
+		server.statuses["token"] = tokenReviewStatus{Authenticated: true, User: tokenReviewUserInfo{Username: "jane"}}
+	})
+	if _, ok, _ := authenticateTestToken(authenticator, "token"); ok {
+		t.Errorf("expected rejection to be cached")
+	}
+}
+
+func TestWebhookAuthenticatorFailurePolicy(t *testing.T) {
+	server := newTestWebhookServer()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		policy FailurePolicy
+		fail   bool
+		delay  time.Duration
+		ok     bool
+	}{
+		{"deny-error", FailurePolicyDeny, true, 0, false},
+		{"deny-timeout", FailurePolicyDeny, false, 200 * time.Millisecond, false},
+		{"anonymous-error", FailurePolicyAnonymous, true, 0, true},
+		{"anonymous-timeout", FailurePolicyAnonymous, false, 200 * time.Millisecond, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.set(func() { server.fail, server.delay = test.fail, test.delay })
+
+			authenticator := NewWebhookAuthenticator(WebhookOpts{URL: server.URL, FailurePolicy: test.policy, Timeout: 50 * time.Millisecond})
+
+			user, ok, err := authenticateTestToken(authenticator, "token")
+			if ok != test.ok {
+				t.Fatalf("expected %v, got %v (%v)", test.ok, ok, err)
+			}
+			if ok && (user.Subject != AnonymousUser || len(user.Groups) != 1 || user.Groups[0] != AnonymousGroup) {
+				t.Errorf("expected anonymous user, got %+v", user)
+			}
+
+			// failures of the webhook are not cached
+			calls := server.callCount()
+			authenticateTestToken(authenticator, "token")
+			if server.callCount() != calls+1 {
+				t.Errorf("expected failure not to be cached")
+			}
+		})
+	}
+}